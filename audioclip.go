@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --------------- Sonos Local Control API ---------------
+
+const (
+	// localAPIPortOffset places the control API next to a player's UPnP
+	// port: 1443 for 1400.
+	localAPIPortOffset = 43
+	localAPIPath       = "/websocket/api"
+	localAPIProtocol   = "v1.api.smartspeaker.audio"
+	audioClipNamespace = "audioClip:1"
+
+	// defaultSonosAPIKey is the key open-source clients of the local API
+	// send; players accept it from the local network.
+	defaultSonosAPIKey = "123e4567-e89b-12d3-a456-426655440000"
+	// audioClipAppID identifies the gateway to the player, in the
+	// reverse-DNS form the API asks for.
+	audioClipAppID = "com.sonosgateway.announcer"
+)
+
+// localAPIHeader is the first element of every control API message.
+// Commands carry Command and CmdID, their answers Response, CmdID and
+// Success, and events Type.
+type localAPIHeader struct {
+	Namespace string `json:"namespace"`
+	Command   string `json:"command,omitempty"`
+	Response  string `json:"response,omitempty"`
+	Type      string `json:"type,omitempty"`
+	PlayerID  string `json:"playerId,omitempty"`
+	CmdID     string `json:"cmdId,omitempty"`
+	Success   *bool  `json:"success,omitempty"`
+}
+
+// localAPIMessage is a [header, body] pair as sent over the WebSocket.
+type localAPIMessage struct {
+	header localAPIHeader
+	body   json.RawMessage
+}
+
+func parseLocalAPIMessage(data []byte) (localAPIMessage, error) {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return localAPIMessage{}, err
+	}
+	if len(parts) == 0 {
+		return localAPIMessage{}, errors.New("empty message")
+	}
+	var msg localAPIMessage
+	if err := json.Unmarshal(parts[0], &msg.header); err != nil {
+		return localAPIMessage{}, err
+	}
+	if len(parts) > 1 {
+		msg.body = parts[1]
+	}
+	return msg, nil
+}
+
+// localAPIError is a command the player turned down, e.g.
+// ERROR_INVALID_PARAMETER.
+type localAPIError struct {
+	Command string
+	Code    string
+	Reason  string
+}
+
+func (e *localAPIError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("%s: %s: %s", e.Command, e.Code, e.Reason)
+	}
+	return fmt.Sprintf("%s: %s", e.Command, e.Code)
+}
+
+// localAPIConn is a control API session with one player. Answers are
+// matched to their commands by cmdId; everything else lands on events.
+type localAPIConn struct {
+	ws       *wsConn
+	playerID string
+	events   chan localAPIMessage
+	done     chan struct{} // closed when the connection is lost
+	err      error         // why it was lost, set before done is closed
+
+	mu      sync.Mutex
+	nextCmd int
+	pending map[string]chan localAPIMessage
+}
+
+// localAPIURL is the control API endpoint of the player at s.Location.
+func localAPIURL(s *SonosSpeaker) (string, error) {
+	u, err := url.Parse(s.Location)
+	if err != nil {
+		return "", err
+	}
+	port := 1400
+	if p := u.Port(); p != "" {
+		if port, err = strconv.Atoi(p); err != nil {
+			return "", err
+		}
+	}
+	host := net.JoinHostPort(u.Hostname(), strconv.Itoa(port+localAPIPortOffset))
+	return "wss://" + host + localAPIPath, nil
+}
+
+// dialLocalAPI connects to a player's control API, waiting at most
+// soapTimeout.
+func dialLocalAPI(ctx context.Context, s *SonosSpeaker, apiKey string) (*localAPIConn, error) {
+	rawURL, err := localAPIURL(s)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	header.Set("X-Sonos-Api-Key", apiKey)
+	header.Set("Sec-WebSocket-Protocol", localAPIProtocol)
+
+	ctx, cancel := context.WithTimeout(ctx, soapTimeout)
+	defer cancel()
+	// Players present certificates for their player ID, signed by Sonos'
+	// own authority, so there is nothing to check them against.
+	ws, err := dialWebSocket(ctx, rawURL, header, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	c := &localAPIConn{
+		ws:       ws,
+		playerID: s.ID,
+		events:   make(chan localAPIMessage, 16),
+		done:     make(chan struct{}),
+		pending:  make(map[string]chan localAPIMessage),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *localAPIConn) readLoop() {
+	for {
+		data, err := c.ws.readMessage()
+		if err != nil {
+			c.err = err
+			close(c.done)
+			return
+		}
+		msg, err := parseLocalAPIMessage(data)
+		if err != nil {
+			log.Printf("Ignoring malformed control API message: %v", err)
+			continue
+		}
+		if msg.header.Response != "" {
+			c.mu.Lock()
+			ch := c.pending[msg.header.CmdID]
+			delete(c.pending, msg.header.CmdID)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- msg
+			}
+			continue
+		}
+		select {
+		case c.events <- msg:
+		default:
+			log.Printf("Dropping control API event %s: nobody is listening", msg.header.Type)
+		}
+	}
+}
+
+// call sends a command and returns the body of the player's answer. It
+// waits at most soapTimeout.
+func (c *localAPIConn) call(ctx context.Context, namespace, command string, body any) (json.RawMessage, error) {
+	c.mu.Lock()
+	c.nextCmd++
+	id := strconv.Itoa(c.nextCmd)
+	answer := make(chan localAPIMessage, 1)
+	c.pending[id] = answer
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	header := localAPIHeader{Namespace: namespace, Command: command, PlayerID: c.playerID, CmdID: id}
+	data, err := json.Marshal([]any{header, body})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ws.writeText(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", command, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, soapTimeout)
+	defer cancel()
+	select {
+	case msg := <-answer:
+		if msg.header.Success != nil && !*msg.header.Success {
+			var e struct {
+				ErrorCode string `json:"errorCode"`
+				Reason    string `json:"reason"`
+			}
+			json.Unmarshal(msg.body, &e)
+			return nil, &localAPIError{Command: command, Code: e.ErrorCode, Reason: e.Reason}
+		}
+		return msg.body, nil
+	case <-c.done:
+		return nil, fmt.Errorf("%s: %w", command, c.err)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s: %w", command, ctx.Err())
+	}
+}
+
+func (c *localAPIConn) close() {
+	c.ws.close()
+}
+
+// --------------- audioClip Backend ---------------
+
+// audioClipBackend plays clips through the audioClip namespace of the local
+// control API. The player mixes the clip over whatever it is playing, which
+// carries on underneath, so there is nothing to snapshot or restore and the
+// interrupt policy does not apply. Every player of a targeted group gets
+// its own clip. Groups with a player without the API, such as one on older
+// firmware, are played through fallback instead.
+type audioClipBackend struct {
+	apiKey   string
+	fallback playbackBackend
+}
+
+// audioClipJSON is the part of an audioClip object the gateway reads.
+type audioClipJSON struct {
+	ID        string `json:"id"`
+	Status    string `json:"status,omitempty"` // ACTIVE, DONE, DISMISSED or ERROR
+	ErrorCode string `json:"errorCode,omitempty"`
+}
+
+type loadAudioClipRequest struct {
+	Name      string `json:"name"`
+	AppID     string `json:"appId"`
+	StreamURL string `json:"streamUrl"`
+	ClipType  string `json:"clipType"`
+	Priority  string `json:"priority"`         // LOW queues behind other clips, HIGH cuts them off
+	Volume    *int   `json:"volume,omitempty"` // the clip's own volume; the music's is untouched
+}
+
+func (b *audioClipBackend) name() string { return playbackAudioClip }
+
+func (b *audioClipBackend) play(ctx context.Context, targets []*SonosSpeaker, parts []*groupParticipant, req playbackRequest) ([]playbackResult, error) {
+	grouped := parts != nil
+	if !grouped {
+		// Clips play on each player by itself, so every member of a target's
+		// group needs its own.
+		members := targetMembers(targets)
+		for i, c := range targets {
+			parts = append(parts, &groupParticipant{speaker: c})
+			for _, m := range members[i] {
+				parts = append(parts, &groupParticipant{speaker: m, coordinator: c})
+			}
+		}
+	}
+	groupOf := func(p *groupParticipant) string {
+		if p.coordinator != nil {
+			return p.coordinator.ID
+		}
+		return p.speaker.ID
+	}
+
+	conns := make([]*localAPIConn, len(parts))
+	forEachParallel(len(parts), fanoutWorkers, func(i int) {
+		s := parts[i].speaker
+		c, err := dialLocalAPI(ctx, s, b.apiKey)
+		if err != nil {
+			log.Printf("Control API of %s unavailable, playing its group through %s: %v", s.Name, b.fallback.name(), err)
+			return
+		}
+		conns[i] = c
+	})
+
+	// A group with a player that lacks the API plays through the fallback as
+	// a whole: played by itself, a member would have to leave its group.
+	fellBack := make(map[string]bool)
+	for i, c := range conns {
+		if c == nil {
+			fellBack[groupOf(parts[i])] = true
+		}
+	}
+	var (
+		fallbackTargets []*SonosSpeaker
+		fallbackParts   []*groupParticipant
+	)
+	for i, p := range parts {
+		if !fellBack[groupOf(p)] {
+			continue
+		}
+		if conns[i] != nil {
+			conns[i].close()
+			conns[i] = nil
+		}
+		fallbackParts = append(fallbackParts, p)
+		if p.coordinator == nil {
+			fallbackTargets = append(fallbackTargets, p.speaker)
+		}
+	}
+
+	var (
+		wg              sync.WaitGroup
+		fallbackResults []playbackResult
+		fallbackErr     error
+		results         = make([]playbackResult, len(parts))
+		errs            = make([]error, len(parts))
+	)
+	if len(fallbackParts) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if grouped {
+				fallbackResults, fallbackErr = b.fallback.play(ctx, nil, fallbackParts, req)
+			} else {
+				fallbackResults, fallbackErr = b.fallback.play(ctx, fallbackTargets, nil, req)
+			}
+		}()
+	}
+	forEachParallel(len(parts), len(parts), func(i int) {
+		c := conns[i]
+		if c == nil {
+			return
+		}
+		defer c.close()
+		s := parts[i].speaker
+		ctx, end := req.stops.begin(ctx, s.ID)
+		defer end()
+		progress := playAudioClip(ctx, c, s, req)
+		results[i] = newPlaybackResult(s, progress)
+		results[i].Backend = b.name()
+		if progress.Status == clipFailed || (progress.Status == clipCancelled && progress.Started.IsZero()) {
+			log.Printf("Error playing on %s: %v", s.Name, progress.Err)
+			errs[i] = fmt.Errorf("%s: %w", s.Name, progress.Err)
+		}
+	})
+	wg.Wait()
+
+	// Grouped, the fallback reports every participant in order; otherwise
+	// only the coordinators, whose members played along with them.
+	byGroup := make(map[string]playbackResult)
+	if !grouped {
+		for _, r := range fallbackResults {
+			byGroup[r.ID] = r
+		}
+	}
+	next := 0
+	for i, p := range parts {
+		if !fellBack[groupOf(p)] {
+			continue
+		}
+		if grouped {
+			results[i] = fallbackResults[next]
+			next++
+			continue
+		}
+		r := byGroup[groupOf(p)]
+		r.Name, r.ID = p.speaker.Name, p.speaker.ID
+		results[i] = r
+	}
+	return results, errors.Join(append(errs, fallbackErr)...)
+}
+
+// playAudioClip plays the clip on one player and follows it until the
+// player reports it done, ctx is cancelled or clipMaxDuration runs out.
+func playAudioClip(ctx context.Context, c *localAPIConn, s *SonosSpeaker, req playbackRequest) clipProgress {
+	var progress clipProgress
+	failed := func(err error) clipProgress {
+		progress.Status, progress.Err = clipFailed, err
+		if ctx.Err() != nil {
+			progress.Status, progress.Err = clipCancelled, context.Cause(ctx)
+		}
+		return progress
+	}
+
+	if _, err := c.call(ctx, audioClipNamespace, "subscribe", struct{}{}); err != nil {
+		return failed(err)
+	}
+	load := loadAudioClipRequest{
+		Name:      clipCreator,
+		AppID:     audioClipAppID,
+		StreamURL: req.clip.url(s),
+		ClipType:  "CUSTOM",
+		Priority:  "LOW",
+	}
+	if req.priority >= priorityHigh {
+		load.Priority = "HIGH"
+	}
+	if vol := req.volume(s); vol != noVolume {
+		load.Volume = &vol
+	}
+	raw, err := c.call(ctx, audioClipNamespace, "loadAudioClip", load)
+	if err != nil {
+		return failed(err)
+	}
+	var loaded audioClipJSON
+	if err := json.Unmarshal(raw, &loaded); err != nil || loaded.ID == "" {
+		return failed(fmt.Errorf("loadAudioClip: unexpected answer %s", raw))
+	}
+	progress.Started = time.Now()
+	log.Printf("Audio clip %s playing on %s", loaded.ID, s.Name)
+
+	// dismiss cancels the clip when we give up on it.
+	dismiss := func() {
+		if _, err := c.call(context.WithoutCancel(ctx), audioClipNamespace, "cancelAudioClip", audioClipJSON{ID: loaded.ID}); err != nil {
+			log.Printf("Cancelling the audio clip on %s failed: %v", s.Name, err)
+		}
+	}
+	timeout := time.NewTimer(clipMaxDuration)
+	defer timeout.Stop()
+	for {
+		select {
+		case msg := <-c.events:
+			if msg.header.Type != "audioClipStatus" {
+				continue
+			}
+			var status struct {
+				AudioClips []audioClipJSON `json:"audioClips"`
+			}
+			if err := json.Unmarshal(msg.body, &status); err != nil {
+				continue
+			}
+			for _, ac := range status.AudioClips {
+				if ac.ID != loaded.ID {
+					continue
+				}
+				switch ac.Status {
+				case "DONE":
+					progress.Status = clipPlayed
+				case "DISMISSED":
+					log.Printf("Audio clip on %s dismissed", s.Name)
+					progress.Status = clipInterrupted
+				case "ERROR":
+					progress.Status = clipFailed
+					progress.Err = fmt.Errorf("audio clip failed: %s", ac.ErrorCode)
+				default:
+					continue
+				}
+				progress.Finished = time.Now()
+				return progress
+			}
+
+		case <-ctx.Done():
+			log.Printf("Announcement on %s cancelled", s.Name)
+			dismiss()
+			progress.Status = clipCancelled
+			progress.Finished = time.Now()
+			progress.Err = context.Cause(ctx)
+			return progress
+
+		case <-timeout.C:
+			dismiss()
+			progress.Status = clipTimeout
+			return progress
+
+		case <-c.done:
+			progress.Status = clipFailed
+			progress.Err = fmt.Errorf("control API connection lost: %w", c.err)
+			return progress
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --------------- Audio File Info ---------------
+
+var errUnknownAudio = errors.New("unrecognized audio file")
+
+// audioMIMEType maps a clip's extension to the MIME type announced to the
+// speaker.
+func audioMIMEType(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		return "audio/mpeg"
+	case ".m4a", ".mp4":
+		return "audio/mp4"
+	case ".aac":
+		return "audio/aac"
+	case ".wav":
+		return "audio/wav"
+	case ".aif", ".aiff":
+		return "audio/aiff"
+	case ".flac":
+		return "audio/flac"
+	case ".ogg":
+		return "audio/ogg"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// audioDuration reads the playing time of an MP3, MP4/M4A, WAV or AIFF file.
+func audioDuration(path string) (time.Duration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		return mp3Duration(data)
+	case ".m4a", ".mp4":
+		return mp4Duration(data)
+	case ".wav":
+		return wavDuration(data)
+	case ".aif", ".aiff":
+		p, err := decodePCM(data)
+		if err != nil {
+			return 0, err
+		}
+		return p.duration(), nil
+	}
+	return 0, fmt.Errorf("%w: %s", errUnknownAudio, filepath.Base(path))
+}
+
+// MPEG audio bitrates in kbit/s by [version 1 or 2][layer 1-3][index].
+var mp3Bitrates = [2][3][15]int{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+var mp3SampleRates = [3]int{44100, 48000, 32000}
+
+// mp3Duration adds up the frames of an MPEG audio stream, which is exact for
+// both constant and variable bitrate files.
+func mp3Duration(data []byte) (time.Duration, error) {
+	i := 0
+	if len(data) >= 10 && string(data[:3]) == "ID3" {
+		size := int(data[6]&0x7f)<<21 | int(data[7]&0x7f)<<14 | int(data[8]&0x7f)<<7 | int(data[9]&0x7f)
+		i = 10 + size
+		if data[5]&0x10 != 0 {
+			i += 10 // footer
+		}
+	}
+
+	var seconds float64
+	frames := 0
+	for i+4 <= len(data) {
+		h := binary.BigEndian.Uint32(data[i:])
+		version := (h >> 19) & 3 // 0: MPEG 2.5, 2: MPEG 2, 3: MPEG 1
+		layer := 4 - (h>>17)&3   // 1-3, 4 is reserved
+		bitrateIdx := (h >> 12) & 0xf
+		rateIdx := (h >> 10) & 3
+		if h&0xffe00000 != 0xffe00000 || version == 1 || layer == 4 || bitrateIdx == 0 || bitrateIdx == 15 || rateIdx == 3 {
+			i++ // not a frame header; resynchronize
+			continue
+		}
+
+		v := 0
+		sampleRate := mp3SampleRates[rateIdx]
+		if version != 3 {
+			v = 1
+			sampleRate /= 2
+			if version == 0 {
+				sampleRate /= 2
+			}
+		}
+		bitrate := mp3Bitrates[v][layer-1][bitrateIdx] * 1000
+
+		samples := 1152
+		switch {
+		case layer == 1:
+			samples = 384
+		case layer == 3 && v == 1:
+			samples = 576
+		}
+		padding := int(h>>9) & 1
+		if layer == 1 {
+			padding *= 4
+		}
+		size := samples/8*bitrate/sampleRate + padding
+		if size < 4 {
+			i++
+			continue
+		}
+
+		seconds += float64(samples) / float64(sampleRate)
+		frames++
+		i += size
+	}
+	if frames == 0 {
+		return 0, fmt.Errorf("%w: no MPEG audio frames", errUnknownAudio)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// mp4Duration reads the movie header (moov/mvhd) of an MP4 or M4A file.
+func mp4Duration(data []byte) (time.Duration, error) {
+	moov, ok := mp4Box(data, "moov")
+	if !ok {
+		return 0, fmt.Errorf("%w: no moov box", errUnknownAudio)
+	}
+	mvhd, ok := mp4Box(moov, "mvhd")
+	if !ok || len(mvhd) < 20 {
+		return 0, fmt.Errorf("%w: no mvhd box", errUnknownAudio)
+	}
+
+	var timescale, duration uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return 0, fmt.Errorf("%w: short mvhd box", errUnknownAudio)
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+		duration = binary.BigEndian.Uint64(mvhd[24:])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	}
+	if timescale == 0 {
+		return 0, fmt.Errorf("%w: zero timescale", errUnknownAudio)
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), nil
+}
+
+// mp4Box returns the payload of the first box of the given type in data.
+func mp4Box(data []byte, boxType string) ([]byte, bool) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, false
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, false
+		}
+		if string(data[4:8]) == boxType {
+			return data[header:size], true
+		}
+		data = data[size:]
+	}
+	return nil, false
+}
+
+// wavDuration divides the size of the data chunk by the byte rate from the
+// fmt chunk.
+func wavDuration(data []byte) (time.Duration, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return 0, fmt.Errorf("%w: not a RIFF/WAVE file", errUnknownAudio)
+	}
+
+	var byteRate, dataSize uint32
+	for chunks := data[12:]; len(chunks) >= 8; {
+		id := string(chunks[:4])
+		size := binary.LittleEndian.Uint32(chunks[4:])
+		body := chunks[8:]
+		if uint64(size) > uint64(len(body)) {
+			size = uint32(len(body)) // truncated or streaming-style header
+		}
+		switch id {
+		case "fmt ":
+			if size >= 12 {
+				byteRate = binary.LittleEndian.Uint32(body[8:])
+			}
+		case "data":
+			dataSize = size
+		}
+		// Chunks are padded to an even size.
+		next := int(size) + int(size&1)
+		if next > len(body) {
+			break
+		}
+		chunks = body[next:]
+	}
+	if byteRate == 0 || dataSize == 0 {
+		return 0, fmt.Errorf("%w: missing fmt or data chunk", errUnknownAudio)
+	}
+	return time.Duration(float64(dataSize) / float64(byteRate) * float64(time.Second)), nil
+}
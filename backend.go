@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+)
+
+// --------------- Playback Backends ---------------
+
+const (
+	playbackUPnP      = "upnp"
+	playbackAudioClip = "audioclip"
+)
+
+// playbackBackend plays announcement clips on speakers.
+type playbackBackend interface {
+	// name is how PLAYBACK_BACKEND and the results refer to the backend.
+	name() string
+	// play plays the clip on every target, or on the zone groups of parts
+	// in group mode, and reports how it went on each speaker once every
+	// clip has finished. Cancelling ctx cuts the clips short.
+	play(ctx context.Context, targets []*SonosSpeaker, parts []*groupParticipant, req playbackRequest) ([]playbackResult, error)
+}
+
+// playbackRequest is what a backend needs to know about an announcement.
+type playbackRequest struct {
+	clip     clip
+	priority int
+	// volume picks a speaker's announcement volume, noVolume to leave it.
+	volume func(*SonosSpeaker) int
+	// stops is where backends that play each speaker on its own register
+	// it, so it can be stopped while the others play on. It may be nil.
+	stops *speakerStops
+}
+
+// playback is the PLAYBACK_BACKEND setting.
+var playback playbackBackend = upnpBackend{}
+
+// loadPlaybackBackend reads PLAYBACK_BACKEND, "upnp" (default) or
+// "audioclip", and SONOS_API_KEY for the latter.
+func loadPlaybackBackend() playbackBackend {
+	switch v := strings.ToLower(strings.TrimSpace(os.Getenv("PLAYBACK_BACKEND"))); v {
+	case "", playbackUPnP:
+		return upnpBackend{}
+	case playbackAudioClip:
+		key := os.Getenv("SONOS_API_KEY")
+		if key == "" {
+			key = defaultSonosAPIKey
+		}
+		return &audioClipBackend{apiKey: key, fallback: upnpBackend{}}
+	default:
+		log.Printf("Invalid PLAYBACK_BACKEND %q, use %q or %q; using %s", v, playbackUPnP, playbackAudioClip, playbackUPnP)
+		return upnpBackend{}
+	}
+}
+
+// upnpBackend plays clips through AVTransport: the clip replaces what the
+// players were playing, which is restored once it ends.
+type upnpBackend struct{}
+
+func (upnpBackend) name() string { return playbackUPnP }
+
+func (b upnpBackend) play(ctx context.Context, targets []*SonosSpeaker, parts []*groupParticipant, req playbackRequest) ([]playbackResult, error) {
+	var (
+		results []playbackResult
+		err     error
+	)
+	if parts != nil {
+		for _, p := range parts {
+			p.volume = req.volume(p.speaker)
+		}
+		results, err = playGrouped(ctx, parts, req.clip)
+	} else {
+		members := targetMembers(targets)
+		plays := make([]*speakerPlayback, len(targets))
+		for i, s := range targets {
+			mediaURL := req.clip.url(s)
+			plays[i] = &speakerPlayback{
+				speaker:  s,
+				mediaURL: mediaURL,
+				metaData: req.clip.didl(mediaURL),
+				volume:   req.volume(s),
+			}
+			for _, m := range members[i] {
+				plays[i].members = append(plays[i].members, &memberVolume{speaker: m, volume: req.volume(m), prev: noVolume})
+			}
+		}
+		results, err = playAll(ctx, plays, req.stops)
+	}
+	for i := range results {
+		results[i].Backend = b.name()
+	}
+	return results, err
+}
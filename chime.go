@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --------------- Chimes ---------------
+
+const (
+	// chimeDir holds uploaded chimes as <name>.wav or <name>.aiff. Files
+	// copied there by hand work the same way.
+	chimeDir = "chimes"
+	// chimeNone asks for no chime, overriding the configured ones.
+	chimeNone = "none"
+	// chimeGap is the pause between the chime and the first word.
+	chimeGap = 250 * time.Millisecond
+
+	maxChimeSize     = 10 << 20
+	maxChimeDuration = 10 * time.Second
+)
+
+// Where a chime comes from.
+const (
+	chimeBundled  = "bundled"
+	chimeUploaded = "uploaded"
+)
+
+var chimeNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,39}$`)
+
+var (
+	// defaultChime is the ANNOUNCE_CHIME setting, played before
+	// announcements whose priority has no chime of its own; empty means none.
+	defaultChime string
+	// priorityChimes holds the ANNOUNCE_CHIMES entries, keyed by priority.
+	priorityChimes map[int]string
+)
+
+// bundledChimes are synthesized rather than shipped as files, at the 22.05
+// kHz mono that say speaks in.
+var bundledChimes = map[string]func() *pcmAudio{
+	"ding-dong": func() *pcmAudio {
+		return synthesize(
+			chimeNote{659.25, 0, 0.9},    // E5
+			chimeNote{523.25, 0.45, 1.2}, // C5
+		)
+	},
+	"bell": func() *pcmAudio {
+		return synthesize(chimeNote{880, 0, 1.6})
+	},
+	"alert": func() *pcmAudio {
+		return synthesize(
+			chimeNote{1046.5, 0, 0.15},
+			chimeNote{1046.5, 0.2, 0.15},
+			chimeNote{1046.5, 0.4, 0.15},
+		)
+	},
+}
+
+// chimeNote is a struck tone: frequency in Hz, start and length in seconds.
+type chimeNote struct {
+	Freq, Start, Length float64
+}
+
+// synthesize renders notes as a bell-like tone with a few inharmonic
+// partials and an exponential decay.
+func synthesize(notes ...chimeNote) *pcmAudio {
+	const rate = 22050
+	var end float64
+	for _, n := range notes {
+		end = math.Max(end, n.Start+n.Length)
+	}
+	mix := make([]float64, int(end*rate)+1)
+	partials := []struct{ ratio, gain float64 }{{1, 1}, {2.76, 0.3}, {5.4, 0.1}}
+	for _, n := range notes {
+		first := int(n.Start * rate)
+		for i := 0; i < int(n.Length*rate); i++ {
+			t := float64(i) / rate
+			// 5ms attack and a decay reaching -40dB at the end avoid clicks.
+			env := math.Min(1, t/0.005) * math.Exp(-4.6*t/n.Length)
+			var v float64
+			for _, p := range partials {
+				v += p.gain * math.Sin(2*math.Pi*n.Freq*p.ratio*t)
+			}
+			mix[first+i] += 0.35 * env * v
+		}
+	}
+
+	p := &pcmAudio{SampleRate: rate, Channels: 1, Samples: make([]int16, len(mix))}
+	for i, v := range mix {
+		p.Samples[i] = int16(math.Max(-1, math.Min(1, v)) * math.MaxInt16)
+	}
+	return p
+}
+
+// loadAnnounceChimes reads ANNOUNCE_CHIME and ANNOUNCE_CHIMES, a
+// comma-separated list of priority=chime pairs such as
+// "urgent=alert,high=ding-dong".
+func loadAnnounceChimes() (string, map[int]string) {
+	def := ""
+	if v := os.Getenv("ANNOUNCE_CHIME"); v != "" {
+		if name, err := parseChime(v); err != nil {
+			log.Printf("Invalid ANNOUNCE_CHIME: %v, announcements play without a chime", err)
+		} else {
+			def = name
+		}
+	}
+
+	perPriority := make(map[int]string)
+	for _, entry := range strings.Split(os.Getenv("ANNOUNCE_CHIMES"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		p, v, found := strings.Cut(entry, "=")
+		priority, perr := parsePriority(strings.TrimSpace(p))
+		name, cerr := parseChime(v)
+		if !found || perr != nil || cerr != nil {
+			log.Printf("Invalid ANNOUNCE_CHIMES entry %q, expected priority=chime", entry)
+			continue
+		}
+		perPriority[priority] = name
+	}
+	return def, perPriority
+}
+
+// parseChime validates a chime name from a request or the configuration.
+// It returns the lower-case name, or chimeNone.
+func parseChime(v string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(v))
+	if name == chimeNone {
+		return chimeNone, nil
+	}
+	if _, _, err := findChime(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// chimeFor picks the chime of an announcement: the one it asked for, else
+// the one configured for its priority, else ANNOUNCE_CHIME. It returns ""
+// for none.
+func chimeFor(opts announceOptions) string {
+	name := opts.Chime
+	if name == "" {
+		name = priorityChimes[opts.Priority]
+	}
+	if name == "" {
+		name = defaultChime
+	}
+	if name == chimeNone {
+		return ""
+	}
+	return name
+}
+
+var errChimeNotFound = errors.New("chime not found")
+
+// findChime returns the file of an uploaded chime, or "" with chimeBundled
+// for a bundled one. Uploads shadow bundled chimes of the same name.
+func findChime(name string) (path, source string, err error) {
+	if !chimeNamePattern.MatchString(name) {
+		return "", "", fmt.Errorf("invalid chime name %q: use lower-case letters, digits, - and _", name)
+	}
+	for _, ext := range []string{".wav", ".aiff", ".aif"} {
+		path := filepath.Join(chimeDir, name+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path, chimeUploaded, nil
+		}
+	}
+	if _, ok := bundledChimes[name]; ok {
+		return "", chimeBundled, nil
+	}
+	return "", "", fmt.Errorf("%w: %q", errChimeNotFound, name)
+}
+
+// loadChime returns the audio of a chime.
+func loadChime(name string) (*pcmAudio, error) {
+	path, source, err := findChime(name)
+	if err != nil {
+		return nil, err
+	}
+	if source == chimeBundled {
+		return bundledChimes[name](), nil
+	}
+	return readPCM(path)
+}
+
+// prependChime puts a chime ahead of the speech in the WAV or AIFF file at
+// path, converted to the speech's sample rate and channels.
+func prependChime(path, name string) error {
+	chime, err := loadChime(name)
+	if err != nil {
+		return err
+	}
+	speech, err := readPCM(path)
+	if err != nil {
+		return err
+	}
+	joined := joinPCM(chime, chimeGap, speech)
+	if strings.EqualFold(filepath.Ext(path), ".wav") {
+		return os.WriteFile(path, encodeWAV(joined), 0644)
+	}
+	return os.WriteFile(path, encodeAIFF(joined), 0644)
+}
+
+// --------------- Chime API ---------------
+
+type chimeJSON struct {
+	Name     string  `json:"name"`
+	Source   string  `json:"source"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+type chimesResponse struct {
+	Chimes []chimeJSON `json:"chimes"`
+	// Default and Priorities show ANNOUNCE_CHIME and ANNOUNCE_CHIMES.
+	Default    string            `json:"default,omitempty"`
+	Priorities map[string]string `json:"priorities,omitempty"`
+}
+
+// listChimes returns every bundled and uploaded chime, sorted by name.
+func listChimes() []chimeJSON {
+	names := make(map[string]bool)
+	for name := range bundledChimes {
+		names[name] = true
+	}
+	if entries, err := os.ReadDir(chimeDir); err == nil {
+		for _, e := range entries {
+			name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+			if !e.IsDir() && chimeNamePattern.MatchString(name) {
+				names[name] = true
+			}
+		}
+	}
+
+	list := make([]chimeJSON, 0, len(names))
+	for name := range names {
+		if entry, err := describeChime(name); err == nil {
+			list = append(list, entry)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func describeChime(name string) (chimeJSON, error) {
+	_, source, err := findChime(name)
+	if err != nil {
+		return chimeJSON{}, err
+	}
+	audio, err := loadChime(name)
+	if err != nil {
+		return chimeJSON{}, err
+	}
+	return chimeJSON{Name: name, Source: source, Duration: audio.duration().Seconds()}, nil
+}
+
+// handleChimes lists the chimes (GET) or stores an upload (POST, a
+// multipart form with the fields "name" and "file").
+func handleChimes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		resp := chimesResponse{Chimes: listChimes(), Default: defaultChime}
+		if len(priorityChimes) > 0 {
+			resp.Priorities = make(map[string]string)
+			for p, name := range priorityChimes {
+				resp.Priorities[priorityNames[p]] = name
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	case http.MethodPost:
+		uploadChime(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func uploadChime(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxChimeSize+1<<20)
+	if err := r.ParseMultipartForm(maxChimeSize); err != nil {
+		http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.ToLower(strings.TrimSpace(r.FormValue("name")))
+	if name == chimeNone {
+		http.Error(w, `"none" is reserved for no chime`, http.StatusBadRequest)
+		return
+	}
+	if !chimeNamePattern.MatchString(name) {
+		http.Error(w, fmt.Sprintf("invalid chime name %q: use lower-case letters, digits, - and _", name), http.StatusBadRequest)
+		return
+	}
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, `"file" is required`, http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	audio, err := decodePCM(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if audio.duration() > maxChimeDuration {
+		http.Error(w, fmt.Sprintf("chime is %.1fs long, the limit is %s", audio.duration().Seconds(), maxChimeDuration), http.StatusBadRequest)
+		return
+	}
+
+	// Keep the file as uploaded; write it aside first so a chime being
+	// joined onto an announcement never reads half a file.
+	path := filepath.Join(chimeDir, name+"."+pcmFormat(data))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	removeChimeFiles(name, path)
+	log.Printf("Stored chime %q (%.1fs)", name, audio.duration().Seconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(chimeJSON{Name: name, Source: chimeUploaded, Duration: audio.duration().Seconds()})
+}
+
+// removeChimeFiles deletes the uploaded files of a chime except keep.
+func removeChimeFiles(name, keep string) (removed bool) {
+	for _, ext := range []string{".wav", ".aiff", ".aif"} {
+		path := filepath.Join(chimeDir, name+ext)
+		if path != keep && os.Remove(path) == nil {
+			removed = true
+		}
+	}
+	return removed
+}
+
+// handleChimeDetail plays back a chime as WAV (GET) or deletes an upload
+// (DELETE). Deleting an upload that shadowed a bundled chime brings the
+// bundled one back.
+func handleChimeDetail(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/chimes/"))
+	path, source, err := findChime(name)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errChimeNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if source == chimeUploaded {
+			w.Header().Set("Content-Type", audioMIMEType(path))
+			http.ServeFile(w, r, path)
+			return
+		}
+		w.Header().Set("Content-Type", "audio/wav")
+		w.Write(encodeWAV(bundledChimes[name]()))
+	case http.MethodDelete:
+		if source == chimeBundled {
+			http.Error(w, "bundled chimes cannot be deleted", http.StatusBadRequest)
+			return
+		}
+		removeChimeFiles(name, "")
+		log.Printf("Deleted chime %q", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// --------------- Announcement Completion ---------------
+
+const (
+	// clipMaxDuration bounds how long we wait for an announcement to finish
+	// before restoring anyway.
+	clipMaxDuration = 5 * time.Minute
+	// clipStartTimeout is how long a clip may take to reach PLAYING. A very
+	// short clip can finish between two polls, so we stop waiting for it.
+	clipStartTimeout = 5 * time.Second
+	clipPollInterval = 500 * time.Millisecond
+)
+
+// How an announcement ended on one speaker.
+const (
+	clipPlayed      = "played"      // played to the end
+	clipInterrupted = "interrupted" // something else took over the transport
+	clipTimeout     = "timeout"     // still playing after clipMaxDuration
+	clipUnconfirmed = "unconfirmed" // never seen playing; it may have been shorter than a poll
+	clipFailed      = "failed"      // the speaker rejected the clip or stopped answering
+	clipCancelled   = "cancelled"   // the caller went away; the speaker was restored early
+	clipSkipped     = "skipped"     // the interrupt policy kept the clip off the speaker
+)
+
+// clipProgress is what completion tracking observed for one clip.
+type clipProgress struct {
+	Status   string
+	Started  time.Time // when Play was accepted
+	Finished time.Time // when the speaker was seen leaving the clip
+	Err      error
+}
+
+// playbackResult reports one speaker's part in an announcement.
+type playbackResult struct {
+	Name       string  `json:"name"`
+	ID         string  `json:"id"`
+	Status     string  `json:"status"`
+	StartedAt  string  `json:"started_at,omitempty"`  // RFC3339 with milliseconds
+	FinishedAt string  `json:"finished_at,omitempty"` // RFC3339 with milliseconds
+	Duration   float64 `json:"duration_seconds,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	Source     string  `json:"source,omitempty"`  // what the speaker was doing before: idle, music, radio, tv or line-in
+	Backend    string  `json:"backend,omitempty"` // the playback backend that played the clip: upnp or audioclip
+}
+
+const resultTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+func newPlaybackResult(s *SonosSpeaker, p clipProgress) playbackResult {
+	r := playbackResult{Name: s.Name, ID: s.ID, Status: p.Status}
+	if !p.Started.IsZero() {
+		r.StartedAt = p.Started.Format(resultTimeFormat)
+	}
+	if !p.Finished.IsZero() {
+		r.FinishedAt = p.Finished.Format(resultTimeFormat)
+		r.Duration = p.Finished.Sub(p.Started).Round(time.Millisecond).Seconds()
+	}
+	if p.Err != nil {
+		r.Error = p.Err.Error()
+	}
+	return r
+}
+
+// anyPlayed reports whether at least one speaker played the announcement.
+func anyPlayed(results []playbackResult) bool {
+	for _, r := range results {
+		if r.Status != clipFailed && r.Status != clipSkipped {
+			return true
+		}
+	}
+	return false
+}
+
+// skippedSpeakers lists the speakers the interrupt policy kept the
+// announcement off, with the reason.
+func skippedSpeakers(results []playbackResult) []string {
+	var skipped []string
+	for _, r := range results {
+		if r.Status == clipSkipped {
+			skipped = append(skipped, fmt.Sprintf("%s (%s)", r.Name, r.Error))
+		}
+	}
+	return skipped
+}
+
+// longestDuration returns the longest measured playback in seconds.
+func longestDuration(results []playbackResult) float64 {
+	var longest float64
+	for _, r := range results {
+		if r.Duration > longest {
+			longest = r.Duration
+		}
+	}
+	return longest
+}
+
+// trackClip follows a clip that started playing at started until the speaker
+// leaves PLAYING, reaches the end of the track, switches to another URI, or
+// ctx is cancelled.
+func trackClip(ctx context.Context, s *SonosSpeaker, mediaURL string, started time.Time) clipProgress {
+	progress := clipProgress{Started: started}
+	seen := false
+	cancelled := func() clipProgress {
+		log.Printf("Announcement on %s cancelled", s.Name)
+		progress.Status = clipCancelled
+		progress.Finished = time.Now()
+		progress.Err = context.Cause(ctx)
+		return progress
+	}
+
+	for time.Since(started) < clipMaxDuration {
+		if sleepContext(ctx, clipPollInterval) != nil {
+			return cancelled()
+		}
+
+		info, err := getTransportInfo(ctx, s)
+		if err != nil {
+			if ctx.Err() != nil {
+				return cancelled()
+			}
+			log.Printf("GetTransportInfo on %s failed while waiting for the clip: %v", s.Name, err)
+			progress.Status = clipFailed
+			progress.Err = err
+			return progress
+		}
+		now := time.Now()
+
+		switch info.CurrentTransportState {
+		case "PLAYING", "TRANSITIONING":
+			seen = true
+			position, err := getPositionInfo(ctx, s)
+			if err != nil {
+				continue
+			}
+			if uri := position.TrackURI; uri != "" && uri != mediaURL {
+				log.Printf("Announcement on %s interrupted by %s", s.Name, uri)
+				progress.Status = clipInterrupted
+				progress.Finished = now
+				return progress
+			}
+			// Some players sit in PLAYING at the very end of a file.
+			duration, derr := parseHMS(position.TrackDuration)
+			rel, rerr := parseHMS(position.RelTime)
+			if derr == nil && rerr == nil && duration > 0 && rel >= duration {
+				progress.Status = clipPlayed
+				progress.Finished = now
+				return progress
+			}
+
+		default:
+			if seen {
+				progress.Status = clipPlayed
+				progress.Finished = now
+				return progress
+			}
+			if now.Sub(started) > clipStartTimeout {
+				progress.Status = clipUnconfirmed
+				return progress
+			}
+		}
+	}
+
+	log.Printf("Announcement on %s still playing after %s, restoring anyway", s.Name, clipMaxDuration)
+	progress.Status = clipTimeout
+	return progress
+}
+
+// parseHMS parses an AVTransport time such as "0:01:23" or "0:00:04.250".
+func parseHMS(v string) (time.Duration, error) {
+	var h, m int
+	var sec float64
+	if _, err := fmt.Sscanf(v, "%d:%d:%f", &h, &m, &sec); err != nil {
+		return 0, fmt.Errorf("bad time %q", v)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec*float64(time.Second)), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+)
+
+// --------------- Device Services ---------------
+
+// defaultControlPaths are the control URLs every Sonos player has used so
+// far. They are only used when a description did not advertise the service,
+// e.g. for a coordinator we only know from the zone group topology.
+var defaultControlPaths = map[string]string{
+	"AVTransport":       "/MediaRenderer/AVTransport/Control",
+	"RenderingControl":  "/MediaRenderer/RenderingControl/Control",
+	"ZoneGroupTopology": "/ZoneGroupTopology/Control",
+}
+
+// defaultEventPaths are the matching GENA event subscription URLs.
+var defaultEventPaths = map[string]string{
+	"AVTransport":       "/MediaRenderer/AVTransport/Event",
+	"RenderingControl":  "/MediaRenderer/RenderingControl/Event",
+	"ZoneGroupTopology": "/ZoneGroupTopology/Event",
+}
+
+// collectServices flattens the service lists of a device and its embedded
+// devices, keyed by short name ("AVTransport"). When a service exists on
+// several embedded devices, the MediaRenderer's copy wins.
+func collectServices(root upnpDevice) map[string]upnpService {
+	services := make(map[string]upnpService)
+	var walk func(d upnpDevice)
+	walk = func(d upnpDevice) {
+		renderer := strings.Contains(d.DeviceType, ":MediaRenderer:")
+		for _, svc := range d.Services {
+			name := serviceShortName(svc.ServiceType)
+			if _, exists := services[name]; !exists || renderer {
+				services[name] = svc
+			}
+		}
+		for _, child := range d.Devices {
+			walk(child)
+		}
+	}
+	walk(root)
+	return services
+}
+
+// serviceShortName turns "urn:schemas-upnp-org:service:AVTransport:1" into
+// "AVTransport".
+func serviceShortName(serviceType string) string {
+	parts := strings.Split(serviceType, ":")
+	if len(parts) >= 2 {
+		return parts[len(parts)-2]
+	}
+	return serviceType
+}
+
+// controlURL returns the absolute control URL for a service, preferring the
+// one advertised in the device description.
+func (s *SonosSpeaker) controlURL(service string) string {
+	path := defaultControlPaths[service]
+	if svc, ok := s.Services[service]; ok && svc.ControlURL != "" {
+		path = svc.ControlURL
+	}
+	return s.absoluteURL(path)
+}
+
+// eventURL returns the absolute event subscription URL for a service,
+// preferring the one advertised in the device description.
+func (s *SonosSpeaker) eventURL(service string) string {
+	path := defaultEventPaths[service]
+	if svc, ok := s.Services[service]; ok && svc.EventSubURL != "" {
+		path = svc.EventSubURL
+	}
+	return s.absoluteURL(path)
+}
+
+// absoluteURL resolves a description-relative URL against the speaker.
+func (s *SonosSpeaker) absoluteURL(path string) string {
+	if strings.Contains(path, "://") {
+		return path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return s.Location + path
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// --------------- DIDL-Lite Metadata ---------------
+
+// clipCreator is shown as the artist of every announcement.
+const clipCreator = "Sonos Gateway"
+
+// maxTitleLength keeps titles derived from long announcement texts readable
+// in the Sonos app.
+const maxTitleLength = 60
+
+// clip is an encoded announcement file and what the speakers are told about
+// it.
+type clip struct {
+	Path     string // relative to the file server root, e.g. tts/123.mp3
+	URL      string // set instead of Path for media the speakers fetch elsewhere
+	Title    string
+	MIMEType string
+	Duration time.Duration // zero if unknown
+}
+
+// newClip describes the file at path. The duration is best effort; without
+// it the speaker simply shows no length.
+func newClip(path, title string) clip {
+	c := clip{Path: path, Title: title, MIMEType: audioMIMEType(path)}
+	d, err := audioDuration(path)
+	if err != nil {
+		log.Printf("Duration of %s unknown: %v", path, err)
+	}
+	c.Duration = d
+	return c
+}
+
+// newURLClip describes media of type mimeType the speakers fetch from
+// rawURL themselves. Its length is unknown.
+func newURLClip(rawURL, title, mimeType string) clip {
+	return clip{URL: rawURL, Title: title, MIMEType: mimeType}
+}
+
+// url is where the speaker fetches the clip: our address on its subnet,
+// unless the clip lives elsewhere.
+func (c clip) url(s *SonosSpeaker) string {
+	if c.URL != "" {
+		return c.URL
+	}
+	return fmt.Sprintf("http://%s:8080/%s", localIPFor(s), c.Path)
+}
+
+// didl renders the DIDL-Lite item passed as CurrentURIMetaData, so the
+// Sonos app shows a title instead of a raw URL.
+func (c clip) didl(url string) string {
+	duration := ""
+	if c.Duration > 0 {
+		duration = ` duration="` + formatDIDLDuration(c.Duration) + `"`
+	}
+	return `<DIDL-Lite xmlns:dc="http://purl.org/dc/elements/1.1/"` +
+		` xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/"` +
+		` xmlns:r="urn:schemas-rinconnetworks-com:metadata-1-0/"` +
+		` xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/">` +
+		`<item id="announcement" parentID="-1" restricted="true">` +
+		`<dc:title>` + xmlEscape(c.Title) + `</dc:title>` +
+		`<dc:creator>` + clipCreator + `</dc:creator>` +
+		`<upnp:class>object.item.audioItem.musicTrack</upnp:class>` +
+		`<res protocolInfo="http-get:*:` + c.MIMEType + `:*"` + duration + `>` + xmlEscape(url) + `</res>` +
+		`</item></DIDL-Lite>`
+}
+
+// formatDIDLDuration formats a duration as H:MM:SS.mmm.
+func formatDIDLDuration(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// clipTitle is the default title of an announcement: its text, shortened.
+func clipTitle(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > maxTitleLength {
+		return string(r[:maxTitleLength-1]) + "…"
+	}
+	return text
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --------------- Discovery Backends ---------------
+
+const (
+	backendSSDP = "ssdp"
+	backendMDNS = "mdns"
+)
+
+// discoveryBackends is the set of enabled backends.
+var discoveryBackends map[string]bool
+
+// loadDiscoveryBackends reads DISCOVERY_BACKENDS, a comma-separated subset of
+// "ssdp,mdns". Both are enabled by default.
+func loadDiscoveryBackends() map[string]bool {
+	spec := os.Getenv("DISCOVERY_BACKENDS")
+	if spec == "" {
+		spec = backendSSDP + "," + backendMDNS
+	}
+
+	backends := make(map[string]bool)
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "":
+		case backendSSDP, backendMDNS:
+			backends[name] = true
+		default:
+			log.Printf("Unknown discovery backend %q in DISCOVERY_BACKENDS", name)
+		}
+	}
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("Discovery backends: %s", strings.Join(names, ", "))
+	return backends
+}
+
+func discoveryBackendEnabled(name string) bool {
+	return discoveryBackends[name]
+}
+
+// --------------- Background Discovery ---------------
+
+// discoveryMissLimit is how many consecutive scans a speaker may miss before
+// it is dropped. A single lost UDP response should not make a room vanish.
+const discoveryMissLimit = 2
+
+// runDiscovery re-runs the discovery backends and re-probes configured speakers every
+// interval, merging the results into the speakers map. An interval of zero
+// or less disables it.
+func runDiscovery(interval time.Duration) {
+	if interval <= 0 {
+		log.Println("Background discovery disabled")
+		return
+	}
+	log.Printf("Background discovery every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// The scan and description fetches happen without holding
+		// speakersMu; only the merge below takes the write lock.
+		applyDiscovery(scanSpeakers())
+		refreshTopology()
+	}
+}
+
+// scanSpeakers runs the discovery backends and probes the configured speakers.
+// A speaker found both ways is reported as configured.
+func scanSpeakers() map[string]*SonosSpeaker {
+	found := discoverSonos()
+	for id, s := range probeStaticSpeakers(staticSpeakers) {
+		found[id] = s
+	}
+	return found
+}
+
+// applyDiscovery merges a scan result into the speakers map, logging every
+// speaker that appeared, changed or went away.
+func applyDiscovery(found map[string]*SonosSpeaker) {
+	now := time.Now()
+
+	speakersMu.Lock()
+	defer speakersMu.Unlock()
+
+	for _, s := range found {
+		mergeSpeakerLocked(s, now)
+	}
+
+	for id, s := range speakers {
+		// Configured speakers stay put even when they miss a scan.
+		if _, ok := found[id]; ok || s.Source == sourceConfig {
+			continue
+		}
+		s.missedScans++
+		if s.missedScans >= discoveryMissLimit {
+			log.Printf("Speaker removed: %s (id: %s), not seen since %s", s.Name, s.ID, s.LastSeen.Format(time.RFC3339))
+			delete(speakers, id)
+		}
+	}
+}
+
+// mergeSpeakerLocked adds s to the speakers map or refreshes the existing
+// entry with the same ID. The caller must hold speakersMu for writing.
+func mergeSpeakerLocked(s *SonosSpeaker, now time.Time) {
+	old, ok := speakers[s.ID]
+	if !ok {
+		log.Printf("Speaker added: %s (id: %s) at %s", s.Name, s.ID, s.Location)
+		s.LastSeen = now
+		s.Online = true
+		speakers[s.ID] = s
+		return
+	}
+	if old.Location != s.Location {
+		log.Printf("Speaker moved: %s (id: %s) %s -> %s", s.Name, s.ID, old.Location, s.Location)
+	}
+	if old.Name != s.Name {
+		log.Printf("Speaker renamed: %s -> %s (id: %s)", old.Name, s.Name, s.ID)
+	}
+	// Update in place so pointers held by in-flight announcements stay valid.
+	old.Name = s.Name
+	old.Location = s.Location
+	old.DescriptionURL = s.DescriptionURL
+	old.LastSeen = now
+	recordHealthLocked(old, nil, now)
+	old.Alias = s.Alias
+	old.Model = s.Model
+	old.ModelNumber = s.ModelNumber
+	old.SerialNum = s.SerialNum
+	old.SoftwareVersion = s.SoftwareVersion
+	old.HardwareVersion = s.HardwareVersion
+	old.Services = s.Services
+	// Configuration is sticky: a configured speaker that also shows up over
+	// SSDP stays configured and is never expired by SSDP max-age.
+	if s.Source == sourceConfig {
+		old.Source = sourceConfig
+	}
+	if old.Source == sourceConfig {
+		old.Expires = time.Time{}
+	} else {
+		old.Expires = s.Expires
+	}
+	old.missedScans = 0
+}
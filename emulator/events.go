@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------- GENA Events ---------------
+
+// maxEventTimeout caps the lease granted to subscribers, like real players
+// do, so renewals get exercised.
+const maxEventTimeout = time.Hour
+
+type eventSubscriber struct {
+	sid      string
+	callback string
+	expires  time.Time
+
+	mu  sync.Mutex // serializes NOTIFYs so SEQ arrives in order
+	seq int64
+}
+
+// eventSource is one evented service of a speaker.
+type eventSource struct {
+	speaker    string
+	service    string
+	lastChange func() string // renders the current LastChange document
+
+	mu   sync.Mutex
+	subs map[string]*eventSubscriber
+}
+
+func newEventSource(speaker, service string, lastChange func() string) *eventSource {
+	return &eventSource{
+		speaker:    speaker,
+		service:    service,
+		lastChange: lastChange,
+		subs:       make(map[string]*eventSubscriber),
+	}
+}
+
+// handleSubscription answers SUBSCRIBE (new or renewal) and UNSUBSCRIBE.
+func (e *eventSource) handleSubscription(w http.ResponseWriter, r *http.Request) {
+	sid := r.Header.Get("SID")
+	switch r.Method {
+	case "SUBSCRIBE":
+		timeout := parseTimeoutHeader(r.Header.Get("TIMEOUT"))
+
+		if sid != "" {
+			e.mu.Lock()
+			sub, ok := e.subs[sid]
+			if ok {
+				sub.expires = time.Now().Add(timeout)
+			}
+			e.mu.Unlock()
+			if !ok {
+				http.Error(w, "Unknown SID", http.StatusPreconditionFailed)
+				return
+			}
+			log.Printf("[%s] %s subscription renewed: %s", e.speaker, e.service, sid)
+			writeSubscribeResponse(w, sid, timeout)
+			return
+		}
+
+		callback := strings.Trim(r.Header.Get("CALLBACK"), "<>")
+		if r.Header.Get("NT") != "upnp:event" || callback == "" {
+			http.Error(w, "Missing CALLBACK or NT", http.StatusPreconditionFailed)
+			return
+		}
+		sub := &eventSubscriber{sid: newSID(), callback: callback, expires: time.Now().Add(timeout)}
+		e.mu.Lock()
+		e.subs[sub.sid] = sub
+		e.mu.Unlock()
+		log.Printf("[%s] %s subscription %s -> %s (%s)", e.speaker, e.service, sub.sid, callback, timeout)
+		writeSubscribeResponse(w, sub.sid, timeout)
+
+		// Every new subscriber gets the full state as event 0.
+		go e.send(sub, e.lastChange())
+
+	case "UNSUBSCRIBE":
+		e.mu.Lock()
+		_, ok := e.subs[sid]
+		delete(e.subs, sid)
+		e.mu.Unlock()
+		if !ok {
+			http.Error(w, "Unknown SID", http.StatusPreconditionFailed)
+			return
+		}
+		log.Printf("[%s] %s subscription cancelled: %s", e.speaker, e.service, sid)
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// publish sends the current state to every live subscriber.
+func (e *eventSource) publish() {
+	doc := e.lastChange()
+	now := time.Now()
+
+	e.mu.Lock()
+	var live []*eventSubscriber
+	for sid, sub := range e.subs {
+		if now.After(sub.expires) {
+			log.Printf("[%s] %s subscription expired: %s", e.speaker, e.service, sid)
+			delete(e.subs, sid)
+			continue
+		}
+		live = append(live, sub)
+	}
+	e.mu.Unlock()
+
+	for _, sub := range live {
+		go e.send(sub, doc)
+	}
+}
+
+func (e *eventSource) send(sub *eventSubscriber, lastChange string) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	body := `<?xml version="1.0"?>` +
+		`<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0"><e:property>` +
+		`<LastChange>` + xmlEscape(lastChange) + `</LastChange>` +
+		`</e:property></e:propertyset>`
+	req, err := http.NewRequest("NOTIFY", sub.callback, strings.NewReader(body))
+	if err != nil {
+		log.Printf("[%s] %s NOTIFY to %s failed: %v", e.speaker, e.service, sub.callback, err)
+		return
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("NTS", "upnp:propchange")
+	req.Header.Set("SID", sub.sid)
+	req.Header.Set("SEQ", strconv.FormatInt(sub.seq, 10))
+	sub.seq++
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("[%s] %s NOTIFY to %s failed: %v", e.speaker, e.service, sub.callback, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("[%s] %s NOTIFY to %s returned %d", e.speaker, e.service, sub.callback, resp.StatusCode)
+	}
+}
+
+func writeSubscribeResponse(w http.ResponseWriter, sid string, timeout time.Duration) {
+	w.Header().Set("SID", sid)
+	w.Header().Set("TIMEOUT", fmt.Sprintf("Second-%d", int(timeout.Seconds())))
+	w.Header().Set("Server", "Linux UPnP/1.0 Sonos/79.1-56030 (ZPS1)")
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseTimeoutHeader reads "Second-1800", capped at maxEventTimeout.
+func parseTimeoutHeader(v string) time.Duration {
+	secs, err := strconv.Atoi(strings.TrimPrefix(v, "Second-"))
+	if err != nil || secs <= 0 || time.Duration(secs)*time.Second > maxEventTimeout {
+		return maxEventTimeout
+	}
+	return time.Duration(secs) * time.Second
+}
+
+func newSID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("uuid:RINCON_%X", b)
+}
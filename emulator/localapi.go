@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------- Local Control API ---------------
+
+// A stand-in for the WebSocket control API newer firmware serves over TLS
+// on port 1443, here 43 above each speaker's HTTP port. Only the audioClip
+// namespace is implemented: a clip lasts -clip-duration and is mixed over
+// whatever the transport plays, which carries on untouched.
+
+const (
+	localAPIPortOffset = 43
+	localAPIProtocol   = "v1.api.smartspeaker.audio"
+	audioClipNamespace = "audioClip:1"
+	wsAcceptGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// newSelfSignedCert makes the certificate every control API endpoint
+// presents. Real players use one signed by Sonos, which clients cannot
+// verify either.
+func newSelfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "Sonos Speaker Emulator"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func startLocalAPI(spk *VirtualSpeaker, cert tls.Certificate) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/websocket/api", func(w http.ResponseWriter, r *http.Request) {
+		handleLocalAPI(w, r, spk)
+	})
+
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", spk.Port+localAPIPortOffset),
+		Handler:   mux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	log.Printf("[%s] Control API starting on wss://%s/websocket/api", spk.Name, srv.Addr)
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
+		log.Fatalf("[%s] Control API failed: %v", spk.Name, err)
+	}
+}
+
+func handleLocalAPI(w http.ResponseWriter, r *http.Request, spk *VirtualSpeaker) {
+	if r.Header.Get("X-Sonos-Api-Key") == "" {
+		http.Error(w, "missing X-Sonos-Api-Key", http.StatusUnauthorized)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(r.Header.Get("Sec-WebSocket-Protocol"), localAPIProtocol) {
+		http.Error(w, "unsupported subprotocol, expected "+localAPIProtocol, http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\nSec-WebSocket-Protocol: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]), localAPIProtocol)
+	log.Printf("[%s] Control API session from %s", spk.Name, r.RemoteAddr)
+
+	s := &apiSession{spk: spk, conn: conn, br: brw.Reader, clips: make(map[string]*audioClip)}
+	s.serve()
+	s.dropClips()
+	log.Printf("[%s] Control API session from %s closed", spk.Name, r.RemoteAddr)
+}
+
+// audioClip is a clip playing on a speaker.
+type audioClip struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	AppID    string `json:"appId"`
+	Priority string `json:"priority"`
+	ClipType string `json:"clipType"`
+	Status   string `json:"status"`
+}
+
+// apiSession is one WebSocket connection to the control API.
+type apiSession struct {
+	spk     *VirtualSpeaker
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+
+	mu         sync.Mutex
+	subscribed bool
+	clips      map[string]*audioClip // active clips by ID
+}
+
+type apiHeader struct {
+	Namespace string `json:"namespace"`
+	Command   string `json:"command,omitempty"`
+	Response  string `json:"response,omitempty"`
+	Type      string `json:"type,omitempty"`
+	PlayerID  string `json:"playerId,omitempty"`
+	CmdID     string `json:"cmdId,omitempty"`
+	Success   *bool  `json:"success,omitempty"`
+}
+
+type apiError struct {
+	ObjectType string `json:"_objectType"`
+	ErrorCode  string `json:"errorCode"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+func (s *apiSession) serve() {
+	for {
+		data, err := s.readMessage()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[%s] Control API read failed: %v", s.spk.Name, err)
+			}
+			return
+		}
+		var parts []json.RawMessage
+		var h apiHeader
+		if json.Unmarshal(data, &parts) != nil || len(parts) == 0 || json.Unmarshal(parts[0], &h) != nil {
+			s.respond(apiHeader{}, nil, &apiError{ErrorCode: "ERROR_INVALID_SYNTAX"})
+			continue
+		}
+		var body json.RawMessage
+		if len(parts) > 1 {
+			body = parts[1]
+		}
+		result, apiErr := s.handle(h, body)
+		s.respond(h, result, apiErr)
+	}
+}
+
+func (s *apiSession) handle(h apiHeader, body json.RawMessage) (any, *apiError) {
+	if h.Namespace != audioClipNamespace {
+		return nil, &apiError{ErrorCode: "ERROR_UNSUPPORTED_NAMESPACE", Reason: h.Namespace}
+	}
+	if h.PlayerID != s.spk.UUID {
+		return nil, &apiError{ErrorCode: "ERROR_INVALID_PARAMETER", Reason: "unknown playerId " + h.PlayerID}
+	}
+
+	switch h.Command {
+	case "subscribe", "unsubscribe":
+		s.mu.Lock()
+		s.subscribed = h.Command == "subscribe"
+		s.mu.Unlock()
+		return struct{}{}, nil
+
+	case "loadAudioClip":
+		var req struct {
+			Name      string `json:"name"`
+			AppID     string `json:"appId"`
+			StreamURL string `json:"streamUrl"`
+			ClipType  string `json:"clipType"`
+			Priority  string `json:"priority"`
+			Volume    *int   `json:"volume"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, &apiError{ErrorCode: "ERROR_INVALID_SYNTAX", Reason: err.Error()}
+		}
+		if req.Name == "" || req.AppID == "" {
+			return nil, &apiError{ErrorCode: "ERROR_INVALID_PARAMETER", Reason: "name and appId are required"}
+		}
+		if req.ClipType == "" {
+			req.ClipType = "CHIME"
+		}
+		if req.ClipType == "CUSTOM" && req.StreamURL == "" {
+			return nil, &apiError{ErrorCode: "ERROR_INVALID_PARAMETER", Reason: "streamUrl is required for CUSTOM clips"}
+		}
+		if req.Priority == "" {
+			req.Priority = "LOW"
+		}
+		return s.loadClip(req.Name, req.AppID, req.ClipType, req.Priority, req.StreamURL, req.Volume), nil
+
+	case "cancelAudioClip":
+		var req struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(body, &req)
+		if !s.finishClip(req.ID, "DISMISSED") {
+			return nil, &apiError{ErrorCode: "ERROR_INVALID_OBJECT_ID", Reason: req.ID}
+		}
+		log.Printf("[%s] Audio clip %s cancelled", s.spk.Name, req.ID)
+		return struct{}{}, nil
+	}
+	return nil, &apiError{ErrorCode: "ERROR_UNSUPPORTED_COMMAND", Reason: h.Command}
+}
+
+// loadClip starts a clip. A HIGH priority clip dismisses the ones playing.
+func (s *apiSession) loadClip(name, appID, clipType, priority, streamURL string, volume *int) audioClip {
+	id := make([]byte, 8)
+	rand.Read(id)
+	c := &audioClip{ID: hex.EncodeToString(id), Name: name, AppID: appID, Priority: priority, ClipType: clipType, Status: "ACTIVE"}
+
+	if priority == "HIGH" {
+		s.mu.Lock()
+		var active []string
+		for id := range s.clips {
+			active = append(active, id)
+		}
+		s.mu.Unlock()
+		for _, id := range active {
+			s.finishClip(id, "DISMISSED")
+		}
+	}
+	s.mu.Lock()
+	s.clips[c.ID] = c
+	s.mu.Unlock()
+
+	t := s.spk.Transport
+	t.mu.Lock()
+	state, uri := t.state, t.uri
+	t.mu.Unlock()
+	vol := "current volume"
+	if volume != nil {
+		vol = fmt.Sprintf("volume %d", *volume)
+	}
+	log.Printf("[%s] Audio clip %s (%s, %s) at %s over %s %s: %s", s.spk.Name, c.ID, clipType, priority, vol, state, uri, streamURL)
+	s.sendStatus(*c)
+
+	go func() {
+		switch {
+		case *play && streamURL != "":
+			playAudio(s.spk.Name, streamURL)
+		case *verify && streamURL != "":
+			verifyMediaURL(s.spk.Name, streamURL)
+			time.Sleep(*clipDuration)
+		default:
+			time.Sleep(*clipDuration)
+		}
+		if s.finishClip(c.ID, "DONE") {
+			log.Printf("[%s] Audio clip %s finished", s.spk.Name, c.ID)
+		}
+	}()
+	return *c
+}
+
+// finishClip ends an active clip with status and tells the subscribers. It
+// reports false if the clip was not active.
+func (s *apiSession) finishClip(id, status string) bool {
+	s.mu.Lock()
+	c := s.clips[id]
+	delete(s.clips, id)
+	s.mu.Unlock()
+	if c == nil {
+		return false
+	}
+	c.Status = status
+	s.sendStatus(*c)
+	return true
+}
+
+// dropClips forgets the clips of a closed session.
+func (s *apiSession) dropClips() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.clips {
+		delete(s.clips, id)
+	}
+}
+
+// sendStatus sends an audioClipStatus event if the client subscribed.
+func (s *apiSession) sendStatus(c audioClip) {
+	s.mu.Lock()
+	subscribed := s.subscribed
+	s.mu.Unlock()
+	if !subscribed {
+		return
+	}
+	h := apiHeader{Namespace: audioClipNamespace, Type: "audioClipStatus", PlayerID: s.spk.UUID}
+	s.writeMessage([]any{h, map[string]any{"audioClips": []audioClip{c}}})
+}
+
+func (s *apiSession) respond(h apiHeader, result any, apiErr *apiError) {
+	ok := apiErr == nil
+	resp := apiHeader{Namespace: h.Namespace, Response: h.Command, PlayerID: h.PlayerID, CmdID: h.CmdID, Success: &ok}
+	if apiErr != nil {
+		log.Printf("[%s] Control API %s failed: %s %s", s.spk.Name, h.Command, apiErr.ErrorCode, apiErr.Reason)
+		apiErr.ObjectType = "globalError"
+		result = apiErr
+	}
+	s.writeMessage([]any{resp, result})
+}
+
+func (s *apiSession) writeMessage(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[%s] Control API encode failed: %v", s.spk.Name, err)
+		return
+	}
+	s.writeFrame(0x1, data)
+}
+
+// writeFrame sends one unmasked final frame, as servers do.
+func (s *apiSession) writeFrame(op byte, payload []byte) {
+	frame := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.Write(append(frame, payload...))
+}
+
+// readMessage returns the next message from the client, answering pings.
+// It returns io.EOF once the client closes.
+func (s *apiSession) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		var h [2]byte
+		if _, err := io.ReadFull(s.br, h[:]); err != nil {
+			return nil, err
+		}
+		fin, op := h[0]&0x80 != 0, h[0]&0x0F
+		if h[1]&0x80 == 0 {
+			return nil, fmt.Errorf("unmasked client frame")
+		}
+		n := uint64(h[1] & 0x7F)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(s.br, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(s.br, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if n > 1<<20 {
+			return nil, fmt.Errorf("frame of %d bytes is too large", n)
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(s.br, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(s.br, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch op {
+		case 0x8: // close
+			s.writeFrame(0x8, payload)
+			return nil, io.EOF
+		case 0x9: // ping
+			s.writeFrame(0xA, payload)
+			continue
+		case 0xA: // pong
+			continue
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
@@ -3,7 +3,11 @@
 // A lightweight emulator that simulates Sonos speakers on the local network
 // for testing the Sonos announcement gateway without real hardware.
 //
-// Supports SSDP discovery, UPnP device descriptions, and AVTransport SOAP control.
+// Supports SSDP discovery (M-SEARCH replies plus ssdp:alive / ssdp:byebye
+// announcements), mDNS/DNS-SD (_sonos._tcp), UPnP device descriptions,
+// AVTransport and RenderingControl SOAP control with simulated playback state,
+// GENA events for both, and a ZoneGroupTopology service describing groups and
+// bonded players.
 //
 // For production testing with the official Sonos Simulator, see:
 //   https://developer.sonos.com/tools/developer-tools/sonos-simulator/
@@ -16,6 +20,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"net"
@@ -25,21 +30,46 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 type VirtualSpeaker struct {
-	Name     string
-	Port     int
-	MediaURI string
+	Name      string
+	Port      int
+	UUID      string
+	Transport *transport
+	Delay     time.Duration // added to every AVTransport and RenderingControl answer
+
+	// GENA event sources for AVTransport and RenderingControl.
+	TransportEvents *eventSource
+	RenderingEvents *eventSource
+
+	// Topology, guarded by topologyMu.
+	Coordinator *VirtualSpeaker   // group coordinator; the speaker itself when standalone
+	BondedTo    *VirtualSpeaker   // primary player when this is an invisible satellite
+	Satellites  []*VirtualSpeaker // bonded satellites of this player
 }
 
+var topologyMu sync.Mutex
+
 var (
 	speakersFlag = flag.String("speakers", "Living Room,Kitchen", "comma-separated list of virtual speaker names")
 	basePort     = flag.Int("port", 1400, "starting HTTP port for the first speaker")
 	verify       = flag.Bool("verify", false, "fetch the media URL on Play to verify accessibility")
 	play         = flag.Bool("play", false, "download and play the TTS audio through Mac speakers using afplay")
+	notifyEvery  = flag.Duration("notify", 30*time.Second, "interval between ssdp:alive announcements (0 disables)")
+	maxAge       = flag.Int("max-age", 1800, "CACHE-CONTROL max-age in seconds advertised over SSDP")
+	groupsFlag   = flag.String("groups", "", `zone groups, e.g. "Living Room+Kitchen;Office+Bedroom" (first name is coordinator)`)
+	bondedFlag   = flag.String("bonded", "", `bonded satellites, e.g. "Living Room=Sub+Surround"`)
+	mdns         = flag.Bool("mdns", true, "answer _sonos._tcp.local mDNS queries")
+	clipDuration = flag.Duration("clip-duration", 3*time.Second, "how long a played clip lasts before the transport stops (with -play, until afplay finishes)")
+	music        = flag.Bool("music", false, "start every coordinator playing its queue, to check that announcements restore it")
+	volumeFlag   = flag.Int("volume", 20, "initial volume of every speaker")
+	slowFlag     = flag.String("slow", "", `delay control answers of some speakers, e.g. "Kitchen=10s", to simulate a hung player`)
+	audioClips   = flag.Bool("audio-clip", true, "serve the audioClip control API over wss on each speaker's port + 43 (false simulates older firmware)")
+	sourceFlag   = flag.String("source", "", `start some coordinators on a source, e.g. "Living Room=tv,Kitchen=line-in" (queue, radio, tv, line-in or idle)`)
 )
 
 func main() {
@@ -55,26 +85,63 @@ func main() {
 		speakers = append(speakers, &VirtualSpeaker{
 			Name: name,
 			Port: *basePort + i,
+			// Derived from the port rather than the name so that
+			// stereo pairs can share a room name, like real players.
+			UUID:      fmt.Sprintf("RINCON_5CAAFD%06X01400", *basePort+i),
+			Transport: newTransport(*volumeFlag),
 		})
+		spk := speakers[len(speakers)-1]
+		spk.TransportEvents = newEventSource(spk.Name, "AVTransport", spk.Transport.avTransportLastChange)
+		spk.RenderingEvents = newEventSource(spk.Name, "RenderingControl", spk.Transport.renderingLastChange)
 	}
 
 	if len(speakers) == 0 {
 		log.Fatal("No speakers configured")
 	}
+	applySlowSpeakers(speakers, *slowFlag)
+	buildTopology(speakers, *groupsFlag, *bondedFlag)
+	if *music {
+		for _, spk := range speakers {
+			if spk.Coordinator == spk && spk.BondedTo == nil {
+				spk.Transport.loadQueue(spk.UUID)
+			}
+		}
+	}
+	applySources(speakers, *sourceFlag)
 
 	localIP := getLocalIP()
 	log.Printf("Local IP: %s", localIP)
 
 	fmt.Println("Virtual Sonos Speakers:")
 	for _, spk := range speakers {
-		fmt.Printf("  - %s on port %d\n", spk.Name, spk.Port)
+		fmt.Printf("  - %s on port %d", spk.Name, spk.Port)
+		switch {
+		case spk.BondedTo != nil:
+			fmt.Printf(" (bonded to %s)", spk.BondedTo.Name)
+		case spk.Coordinator != spk:
+			fmt.Printf(" (grouped with %s)", spk.Coordinator.Name)
+		}
+		fmt.Println()
 	}
 
 	for _, spk := range speakers {
-		go startSpeakerHTTP(spk)
+		go startSpeakerHTTP(spk, speakers, localIP)
+	}
+	if *audioClips {
+		cert, err := newSelfSignedCert()
+		if err != nil {
+			log.Fatalf("Control API certificate: %v", err)
+		}
+		for _, spk := range speakers {
+			go startLocalAPI(spk, cert)
+		}
 	}
 
 	go startSSDPResponder(speakers, localIP)
+	go startSSDPNotifier(speakers, localIP)
+	if *mdns {
+		go startMDNSResponder(speakers, localIP)
+	}
 
 	log.Println("Sonos Emulator Ready")
 
@@ -82,6 +149,53 @@ func main() {
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	<-sig
 	log.Println("Shutting down")
+	sendSSDPNotify(speakers, localIP, "ssdp:byebye")
+}
+
+// applySlowSpeakers parses -slow ("Kitchen=10s,Office=2s").
+func applySlowSpeakers(speakers []*VirtualSpeaker, spec string) {
+	for _, entry := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			log.Fatalf("Invalid -slow entry %q: %v", entry, err)
+		}
+		found := false
+		for _, spk := range speakers {
+			if strings.EqualFold(spk.Name, strings.TrimSpace(name)) {
+				spk.Delay = d
+				found = true
+			}
+		}
+		if !found {
+			log.Fatalf("Invalid -slow entry %q: no speaker named %q", entry, name)
+		}
+	}
+}
+
+// applySources parses -source and puts the named speakers on their source.
+func applySources(speakers []*VirtualSpeaker, spec string) {
+	for _, entry := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		found := false
+		for _, spk := range speakers {
+			if strings.EqualFold(spk.Name, strings.TrimSpace(name)) {
+				if err := spk.Transport.loadSource(spk.UUID, strings.TrimSpace(value)); err != nil {
+					log.Fatalf("Invalid -source entry %q: %v", entry, err)
+				}
+				found = true
+			}
+		}
+		if !found {
+			log.Fatalf("Invalid -source entry %q: no speaker named %q", entry, name)
+		}
+	}
 }
 
 // --------------- Network helpers ---------------
@@ -137,10 +251,10 @@ func startSSDPResponder(speakers []*VirtualSpeaker, localIP string) {
 		for _, spk := range speakers {
 			location := fmt.Sprintf("http://%s:%d/xml/device_description.xml", localIP, spk.Port)
 			response := "HTTP/1.1 200 OK\r\n" +
-				"CACHE-CONTROL: max-age=1800\r\n" +
+				fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", *maxAge) +
 				"LOCATION: " + location + "\r\n" +
 				"ST: urn:schemas-upnp-org:device:ZonePlayer:1\r\n" +
-				"USN: uuid:RINCON_EMULATED_" + strings.ReplaceAll(spk.Name, " ", "") + "\r\n" +
+				"USN: " + speakerUSN(spk) + "\r\n" +
 				"\r\n"
 			respConn.Write([]byte(response))
 		}
@@ -148,15 +262,70 @@ func startSSDPResponder(speakers []*VirtualSpeaker, localIP string) {
 	}
 }
 
+// startSSDPNotifier multicasts ssdp:alive for every speaker at startup and
+// then every -notify interval, the way real players keep their lease alive.
+func startSSDPNotifier(speakers []*VirtualSpeaker, localIP string) {
+	if *notifyEvery <= 0 {
+		return
+	}
+	sendSSDPNotify(speakers, localIP, "ssdp:alive")
+
+	ticker := time.NewTicker(*notifyEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		sendSSDPNotify(speakers, localIP, "ssdp:alive")
+	}
+}
+
+func sendSSDPNotify(speakers []*VirtualSpeaker, localIP, nts string) {
+	addr := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		log.Printf("[SSDP] Failed to send %s: %v", nts, err)
+		return
+	}
+	defer conn.Close()
+
+	for _, spk := range speakers {
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"NT: urn:schemas-upnp-org:device:ZonePlayer:1\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"USN: " + speakerUSN(spk) + "\r\n"
+		if nts == "ssdp:alive" {
+			location := fmt.Sprintf("http://%s:%d/xml/device_description.xml", localIP, spk.Port)
+			msg += fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", *maxAge) +
+				"LOCATION: " + location + "\r\n"
+		}
+		msg += "\r\n"
+		conn.Write([]byte(msg))
+	}
+	log.Printf("[SSDP] Sent %s for %d speaker(s)", nts, len(speakers))
+}
+
+func speakerUSN(spk *VirtualSpeaker) string {
+	return "uuid:" + spk.UUID + "::urn:schemas-upnp-org:device:ZonePlayer:1"
+}
+
 // --------------- Per-Speaker HTTP Server ---------------
 
-func startSpeakerHTTP(spk *VirtualSpeaker) {
+func startSpeakerHTTP(spk *VirtualSpeaker, speakers []*VirtualSpeaker, localIP string) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/xml/device_description.xml", func(w http.ResponseWriter, r *http.Request) {
 		handleDeviceDescription(w, r, spk)
 	})
 	mux.HandleFunc("/MediaRenderer/AVTransport/Control", func(w http.ResponseWriter, r *http.Request) {
-		handleSOAPAction(w, r, spk)
+		time.Sleep(spk.Delay)
+		handleSOAPAction(w, r, spk, speakers)
+	})
+	mux.HandleFunc("/MediaRenderer/RenderingControl/Control", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(spk.Delay)
+		handleRenderingControl(w, r, spk)
+	})
+	mux.HandleFunc("/MediaRenderer/AVTransport/Event", spk.TransportEvents.handleSubscription)
+	mux.HandleFunc("/MediaRenderer/RenderingControl/Event", spk.RenderingEvents.handleSubscription)
+	mux.HandleFunc("/ZoneGroupTopology/Control", func(w http.ResponseWriter, r *http.Request) {
+		handleZoneGroupTopology(w, r, speakers, localIP, spk)
 	})
 
 	addr := fmt.Sprintf(":%d", spk.Port)
@@ -169,59 +338,228 @@ func startSpeakerHTTP(spk *VirtualSpeaker) {
 func handleDeviceDescription(w http.ResponseWriter, r *http.Request, spk *VirtualSpeaker) {
 	log.Printf("[%s] Device description requested by %s", spk.Name, r.RemoteAddr)
 	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	// Mirrors the layout of a real player: ZonePlayer root device with
+	// MediaServer and MediaRenderer embedded devices.
 	fmt.Fprintf(w, `<?xml version="1.0"?>
 <root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
   <device>
-    <roomName>%s</roomName>
-    <displayName>%s</displayName>
+    <deviceType>urn:schemas-upnp-org:device:ZonePlayer:1</deviceType>
+    <friendlyName>%[1]s - Sonos One (Emulated)</friendlyName>
+    <manufacturer>Sonos, Inc.</manufacturer>
+    <modelNumber>S18</modelNumber>
     <modelName>Sonos One (Emulated)</modelName>
+    <softwareVersion>79.1-56030</softwareVersion>
+    <hardwareVersion>1.26.1.0-2.2</hardwareVersion>
+    <serialNum>5C-AA-FD-%02[2]X-%02[3]X-%02[4]X:E</serialNum>
+    <UDN>uuid:%[5]s</UDN>
+    <roomName>%[1]s</roomName>
+    <displayName>%[1]s</displayName>
+    <serviceList>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:ZoneGroupTopology:1</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ZoneGroupTopology</serviceId>
+        <controlURL>/ZoneGroupTopology/Control</controlURL>
+        <eventSubURL>/ZoneGroupTopology/Event</eventSubURL>
+        <SCPDURL>/xml/ZoneGroupTopology1.xml</SCPDURL>
+      </service>
+    </serviceList>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+        <UDN>uuid:%[5]s_MS</UDN>
+        <serviceList>
+          <service>
+            <serviceType>urn:schemas-upnp-org:service:ConnectionManager:1</serviceType>
+            <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+            <controlURL>/MediaServer/ConnectionManager/Control</controlURL>
+            <eventSubURL>/MediaServer/ConnectionManager/Event</eventSubURL>
+            <SCPDURL>/xml/ConnectionManager1.xml</SCPDURL>
+          </service>
+        </serviceList>
+      </device>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+        <UDN>uuid:%[5]s_MR</UDN>
+        <serviceList>
+          <service>
+            <serviceType>urn:schemas-upnp-org:service:RenderingControl:1</serviceType>
+            <serviceId>urn:upnp-org:serviceId:RenderingControl</serviceId>
+            <controlURL>/MediaRenderer/RenderingControl/Control</controlURL>
+            <eventSubURL>/MediaRenderer/RenderingControl/Event</eventSubURL>
+            <SCPDURL>/xml/RenderingControl1.xml</SCPDURL>
+          </service>
+          <service>
+            <serviceType>urn:schemas-upnp-org:service:ConnectionManager:1</serviceType>
+            <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+            <controlURL>/MediaRenderer/ConnectionManager/Control</controlURL>
+            <eventSubURL>/MediaRenderer/ConnectionManager/Event</eventSubURL>
+            <SCPDURL>/xml/ConnectionManager1.xml</SCPDURL>
+          </service>
+          <service>
+            <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+            <serviceId>urn:upnp-org:serviceId:AVTransport</serviceId>
+            <controlURL>/MediaRenderer/AVTransport/Control</controlURL>
+            <eventSubURL>/MediaRenderer/AVTransport/Event</eventSubURL>
+            <SCPDURL>/xml/AVTransport1.xml</SCPDURL>
+          </service>
+        </serviceList>
+      </device>
+    </deviceList>
   </device>
-</root>`, spk.Name, spk.Name)
+</root>`, xmlEscape(spk.Name), byte(spk.Port>>16), byte(spk.Port>>8), byte(spk.Port), spk.UUID)
 }
 
-func handleSOAPAction(w http.ResponseWriter, r *http.Request, spk *VirtualSpeaker) {
-	soapAction := r.Header.Get("SOAPAction")
+func handleSOAPAction(w http.ResponseWriter, r *http.Request, spk *VirtualSpeaker, speakers []*VirtualSpeaker) {
+	action := soapActionName(r)
 	body, _ := io.ReadAll(r.Body)
 	bodyStr := string(body)
+	t := spk.Transport
 
-	// Extract action name from header
-	// Format: "urn:schemas-upnp-org:service:AVTransport:1#SetAVTransportURI"
-	action := soapAction
-	if idx := strings.LastIndex(soapAction, "#"); idx >= 0 {
-		action = soapAction[idx+1:]
-	}
-	action = strings.Trim(action, `"`)
-
+	var out string
 	switch action {
 	case "SetAVTransportURI":
 		mediaURI := extractTagValue(bodyStr, "CurrentURI")
-		spk.MediaURI = mediaURI
 		log.Printf("[%s] SetAVTransportURI -> URI: %s", spk.Name, mediaURI)
+		if uuid, ok := strings.CutPrefix(mediaURI, "x-rincon:"); ok {
+			if err := joinGroup(spk, uuid, speakers); err != nil {
+				log.Printf("[%s] Join rejected: %v", spk.Name, err)
+				writeSOAPFault(w, 800, "Cannot join group")
+				return
+			}
+			t.setURI(mediaURI, "")
+			break
+		}
+		topologyMu.Lock()
+		if spk.Coordinator != spk {
+			log.Printf("[%s] WARNING: transport command sent to a group member (coordinator is %s)", spk.Name, spk.Coordinator.Name)
+		}
+		topologyMu.Unlock()
+		metaData := extractTagValue(bodyStr, "CurrentURIMetaData")
+		if title := extractTagValue(metaData, "dc:title"); title != "" {
+			log.Printf("[%s] Title: %q by %q", spk.Name, title, extractTagValue(metaData, "dc:creator"))
+		}
+		t.setURI(mediaURI, metaData)
+
+	case "BecomeCoordinatorOfStandaloneGroup":
+		leaveGroup(spk, speakers)
+		t.setURI("", "")
+		log.Printf("[%s] BecomeCoordinatorOfStandaloneGroup", spk.Name)
 
 	case "Play":
-		log.Printf("[%s] Play (URI: %s)", spk.Name, spk.MediaURI)
-		if *play && spk.MediaURI != "" {
-			go playAudio(spk.Name, spk.MediaURI)
-		} else if *verify && spk.MediaURI != "" {
-			go verifyMediaURL(spk.Name, spk.MediaURI)
+		t.mu.Lock()
+		uri := t.uri
+		t.mu.Unlock()
+		if uri == "" {
+			log.Printf("[%s] Play rejected: nothing loaded", spk.Name)
+			writeSOAPFault(w, 701, "Transition not available")
+			return
+		}
+		gen := t.play()
+		log.Printf("[%s] Play (URI: %s)", spk.Name, uri)
+		for _, m := range groupMembers(spk, speakers) {
+			log.Printf("[%s] Playing along with coordinator %s", m.Name, spk.Name)
 		}
+		if isClip(uri) {
+			go playClip(spk, uri, gen)
+		}
+
+	case "Pause":
+		t.pause()
+		log.Printf("[%s] Pause", spk.Name)
+
+	case "Stop":
+		t.stop()
+		log.Printf("[%s] Stop", spk.Name)
+
+	case "Seek":
+		unit, target := extractTagValue(bodyStr, "Unit"), extractTagValue(bodyStr, "Target")
+		if err := t.seek(unit, target); err != nil {
+			log.Printf("[%s] Seek %s %s rejected: %v", spk.Name, unit, target, err)
+			writeSOAPFault(w, 711, "Illegal seek target")
+			return
+		}
+		log.Printf("[%s] Seek %s -> %s", spk.Name, unit, target)
+
+	case "GetTransportInfo":
+		t.mu.Lock()
+		out = fmt.Sprintf("<CurrentTransportState>%s</CurrentTransportState>"+
+			"<CurrentTransportStatus>OK</CurrentTransportStatus>"+
+			"<CurrentSpeed>1</CurrentSpeed>", t.state)
+		t.mu.Unlock()
+
+	case "GetMediaInfo":
+		t.mu.Lock()
+		out = fmt.Sprintf("<NrTracks>%d</NrTracks><MediaDuration>NOT_IMPLEMENTED</MediaDuration>"+
+			"<CurrentURI>%s</CurrentURI><CurrentURIMetaData>%s</CurrentURIMetaData>"+
+			"<NextURI></NextURI><NextURIMetaData></NextURIMetaData>"+
+			"<PlayMedium>NETWORK</PlayMedium><RecordMedium>NOT_IMPLEMENTED</RecordMedium>"+
+			"<WriteStatus>NOT_IMPLEMENTED</WriteStatus>",
+			t.nrTracks, xmlEscape(t.uri), xmlEscape(t.metaData))
+		t.mu.Unlock()
+
+	case "GetPositionInfo":
+		t.mu.Lock()
+		out = fmt.Sprintf("<Track>%d</Track><TrackDuration>%s</TrackDuration>"+
+			"<TrackMetaData>%s</TrackMetaData><TrackURI>%s</TrackURI>"+
+			"<RelTime>%s</RelTime><AbsTime>NOT_IMPLEMENTED</AbsTime>"+
+			"<RelCount>2147483647</RelCount><AbsCount>2147483647</AbsCount>",
+			t.track, t.trackDurationLocked(), xmlEscape(t.trackMetaDataLocked()),
+			xmlEscape(t.trackURILocked()), formatHMS(t.positionLocked()))
+		t.mu.Unlock()
 
 	default:
 		log.Printf("[%s] Unknown SOAP action: %s", spk.Name, action)
+		writeSOAPFault(w, 401, "Invalid Action")
+		return
 	}
 
-	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `<?xml version="1.0"?>
-<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
-  <s:Body>
-    <u:%sResponse xmlns:u="urn:schemas-upnp-org:service:AVTransport:1"/>
-  </s:Body>
-</s:Envelope>`, action)
+	writeSOAPResponse(w, "urn:schemas-upnp-org:service:AVTransport:1", action, out)
+
+	switch action {
+	case "SetAVTransportURI", "BecomeCoordinatorOfStandaloneGroup", "Play", "Pause", "Stop", "Seek":
+		spk.TransportEvents.publish()
+	}
+}
+
+// playClip plays or verifies a clip as the flags ask, then stops the
+// transport the way a player does when a single file ends.
+func playClip(spk *VirtualSpeaker, uri string, gen int) {
+	switch {
+	case *play:
+		playAudio(spk.Name, uri)
+	case *verify:
+		verifyMediaURL(spk.Name, uri)
+		time.Sleep(*clipDuration)
+	default:
+		time.Sleep(*clipDuration)
+	}
+	if spk.Transport.finishClip(gen) {
+		log.Printf("[%s] Clip finished, transport STOPPED", spk.Name)
+		spk.TransportEvents.publish()
+	}
 }
 
 // --------------- Helpers ---------------
 
+// soapActionName extracts the action from the SOAPAction header.
+// Format: "urn:schemas-upnp-org:service:AVTransport:1#SetAVTransportURI"
+func soapActionName(r *http.Request) string {
+	action := r.Header.Get("SOAPAction")
+	if idx := strings.LastIndex(action, "#"); idx >= 0 {
+		action = action[idx+1:]
+	}
+	return strings.Trim(action, `"`)
+}
+
+func xmlEscape(s string) string {
+	s = strings.ReplaceAll(s, "&", "&amp;")
+	s = strings.ReplaceAll(s, "<", "&lt;")
+	s = strings.ReplaceAll(s, ">", "&gt;")
+	s = strings.ReplaceAll(s, `"`, "&quot;")
+	return s
+}
+
 func extractTagValue(body, tag string) string {
 	start := strings.Index(body, "<"+tag+">")
 	if start < 0 {
@@ -232,12 +570,10 @@ func extractTagValue(body, tag string) string {
 	if end < 0 {
 		return ""
 	}
-	value := body[start : start+end]
-	value = strings.ReplaceAll(value, "&amp;", "&")
-	value = strings.ReplaceAll(value, "&lt;", "<")
-	value = strings.ReplaceAll(value, "&gt;", ">")
-	value = strings.ReplaceAll(value, "&quot;", `"`)
-	return value
+	// One level of unescaping, numeric references included: the gateway's
+	// encoder writes quotes as &#34;, and DIDL-Lite stored half-escaped
+	// would be escaped again on the way out.
+	return html.UnescapeString(body[start : start+end])
 }
 
 func playAudio(speakerName, mediaURL string) {
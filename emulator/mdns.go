@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// --------------- mDNS Responder ---------------
+
+const (
+	sonosService = "_sonos._tcp.local"
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+	dnsClassIN = 1
+)
+
+// startMDNSResponder answers _sonos._tcp.local PTR queries the way players
+// do: PTR to each instance plus SRV, TXT and A records. Queries from a port
+// other than 5353 get a unicast reply (RFC 6762 legacy unicast).
+func startMDNSResponder(speakers []*VirtualSpeaker, localIP string) {
+	group := &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log.Printf("[mDNS] Listen error, responder disabled: %v", err)
+		return
+	}
+	defer conn.Close()
+	log.Println("[mDNS] Listening on 224.0.0.251:5353")
+
+	buf := make([]byte, 9000)
+	for {
+		n, remoteAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("[mDNS] Read error: %v", err)
+			continue
+		}
+
+		query := buf[:n]
+		if !isSonosQuery(query) {
+			continue
+		}
+		log.Printf("[mDNS] Query for %s from %s", sonosService, remoteAddr)
+
+		legacy := remoteAddr.Port != 5353
+		resp := buildMDNSResponse(query, speakers, localIP, legacy)
+		dest := group
+		if legacy {
+			dest = remoteAddr
+		}
+		if _, err := conn.WriteToUDP(resp, dest); err != nil {
+			log.Printf("[mDNS] Reply to %s failed: %v", dest, err)
+		}
+	}
+}
+
+// isSonosQuery reports whether a DNS message is a query with a PTR or ANY
+// question for _sonos._tcp.local.
+func isSonosQuery(msg []byte) bool {
+	if len(msg) < 12 || msg[2]&0x80 != 0 { // responses have QR set
+		return false
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		var labels []string
+		for off < len(msg) && msg[off] != 0 {
+			l := int(msg[off])
+			if l&0xC0 != 0 || off+1+l > len(msg) {
+				return false // queries we care about are never compressed
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+		off++
+		if off+4 > len(msg) {
+			return false
+		}
+		qtype := binary.BigEndian.Uint16(msg[off:])
+		off += 4
+		if strings.EqualFold(strings.Join(labels, "."), sonosService) && (qtype == dnsTypePTR || qtype == dnsTypeANY) {
+			return true
+		}
+	}
+	return false
+}
+
+func buildMDNSResponse(query []byte, speakers []*VirtualSpeaker, localIP string, legacy bool) []byte {
+	ttl := uint32(4500)
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // response, authoritative
+
+	if legacy {
+		// Legacy unicast replies echo the ID and question and use short TTLs.
+		copy(msg[0:2], query[0:2])
+		binary.BigEndian.PutUint16(msg[4:], 1)
+		msg = appendName(msg, sonosService)
+		msg = binary.BigEndian.AppendUint16(msg, dnsTypePTR)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+		ttl = 10
+	}
+
+	var answers, additional int
+	host := func(spk *VirtualSpeaker) string {
+		return "Sonos-" + spk.UUID[7:19] + ".local"
+	}
+	instance := func(spk *VirtualSpeaker) string {
+		return spk.UUID + "@" + spk.Name + "." + sonosService
+	}
+
+	for _, spk := range speakers {
+		msg = appendRecord(msg, sonosService, dnsTypePTR, ttl, appendName(nil, instance(spk)))
+		answers++
+	}
+	for _, spk := range speakers {
+		// The secure control API port sits 43 above the UPnP port, which
+		// gives 1443 for the default 1400.
+		srv := binary.BigEndian.AppendUint16(nil, 0) // priority
+		srv = binary.BigEndian.AppendUint16(srv, 0)  // weight
+		srv = binary.BigEndian.AppendUint16(srv, uint16(spk.Port+43))
+		srv = appendName(srv, host(spk))
+		msg = appendRecord(msg, instance(spk), dnsTypeSRV, ttl, srv)
+
+		var txt []byte
+		for _, kv := range []string{
+			"info=/api/v1/players/" + spk.UUID + "/info",
+			"vers=3",
+			"protovers=1.24.1",
+			fmt.Sprintf("location=http://%s:%d/xml/device_description.xml", localIP, spk.Port),
+			fmt.Sprintf("sslport=%d", spk.Port+43),
+		} {
+			txt = append(txt, byte(len(kv)))
+			txt = append(txt, kv...)
+		}
+		msg = appendRecord(msg, instance(spk), dnsTypeTXT, ttl, txt)
+
+		msg = appendRecord(msg, host(spk), dnsTypeA, ttl, net.ParseIP(localIP).To4())
+		additional += 3
+	}
+
+	binary.BigEndian.PutUint16(msg[6:], uint16(answers))
+	binary.BigEndian.PutUint16(msg[10:], uint16(additional))
+	return msg
+}
+
+func appendName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+func appendRecord(msg []byte, name string, rtype uint16, ttl uint32, rdata []byte) []byte {
+	msg = appendName(msg, name)
+	msg = binary.BigEndian.AppendUint16(msg, rtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	return append(msg, rdata...)
+}
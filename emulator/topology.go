@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// --------------- Zone Group Topology ---------------
+
+// buildTopology applies the -groups and -bonded flags. Every speaker starts as
+// the coordinator of its own group. Names refer to the first speaker with
+// that name; a satellite named like its primary (a stereo pair) refers to
+// the next speaker with that name.
+//
+//	-groups "Living Room+Kitchen;Office+Bedroom"  first name coordinates the group
+//	-bonded "Living Room=Sub+Surround"            invisible satellites of a player
+func buildTopology(speakers []*VirtualSpeaker, groupsSpec, bondedSpec string) {
+	byName := make(map[string][]*VirtualSpeaker, len(speakers))
+	for _, spk := range speakers {
+		spk.Coordinator = spk
+		byName[spk.Name] = append(byName[spk.Name], spk)
+	}
+	lookupExcept := func(name string, except *VirtualSpeaker) *VirtualSpeaker {
+		name = strings.TrimSpace(name)
+		for _, spk := range byName[name] {
+			if spk != except {
+				return spk
+			}
+		}
+		log.Fatalf("Topology refers to unknown speaker %q", name)
+		return nil
+	}
+	lookup := func(name string) *VirtualSpeaker {
+		return lookupExcept(name, nil)
+	}
+
+	for _, group := range splitSpec(groupsSpec, ";") {
+		names := splitSpec(group, "+")
+		coordinator := lookup(names[0])
+		for _, name := range names[1:] {
+			lookup(name).Coordinator = coordinator
+		}
+	}
+
+	for _, set := range splitSpec(bondedSpec, ";") {
+		primaryName, rest, ok := strings.Cut(set, "=")
+		if !ok {
+			log.Fatalf("Invalid -bonded entry %q, want Primary=Sat1+Sat2", set)
+		}
+		primary := lookup(primaryName)
+		for _, name := range splitSpec(rest, "+") {
+			sat := lookupExcept(name, primary)
+			sat.BondedTo = primary
+			primary.Satellites = append(primary.Satellites, sat)
+		}
+	}
+	// Satellites always play with their primary's group.
+	for _, spk := range speakers {
+		if spk.BondedTo != nil {
+			spk.Coordinator = spk.BondedTo.Coordinator
+		}
+	}
+}
+
+// joinGroup moves spk and its satellites into the group coordinated by the
+// player with the given UUID, as x-rincon:<uuid> does on a real player. If
+// spk coordinated other players, they stay together under the first of them.
+func joinGroup(spk *VirtualSpeaker, uuid string, speakers []*VirtualSpeaker) error {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+
+	var coordinator *VirtualSpeaker
+	for _, c := range speakers {
+		if c.UUID == uuid {
+			coordinator = c
+		}
+	}
+	switch {
+	case coordinator == nil:
+		return fmt.Errorf("unknown player %s", uuid)
+	case spk.BondedTo != nil:
+		return fmt.Errorf("%s is a bonded satellite", spk.Name)
+	case coordinator.Coordinator != coordinator:
+		return fmt.Errorf("%s is not a group coordinator", coordinator.Name)
+	}
+
+	detachLocked(spk, speakers)
+	spk.Coordinator = coordinator
+	for _, sat := range spk.Satellites {
+		sat.Coordinator = coordinator
+	}
+	log.Printf("[%s] Joined group of %s", spk.Name, coordinator.Name)
+	return nil
+}
+
+// leaveGroup makes spk a standalone player, as
+// BecomeCoordinatorOfStandaloneGroup does.
+func leaveGroup(spk *VirtualSpeaker, speakers []*VirtualSpeaker) {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+
+	detachLocked(spk, speakers)
+	spk.Coordinator = spk
+	for _, sat := range spk.Satellites {
+		sat.Coordinator = spk
+	}
+}
+
+// detachLocked hands the players spk coordinates to a new coordinator before
+// spk leaves its group. The caller must hold topologyMu.
+func detachLocked(spk *VirtualSpeaker, speakers []*VirtualSpeaker) {
+	if spk.Coordinator != spk {
+		return
+	}
+	var next *VirtualSpeaker
+	for _, other := range speakers {
+		if other != spk && other.Coordinator == spk && other.BondedTo == nil {
+			next = other
+			break
+		}
+	}
+	if next == nil {
+		return
+	}
+	for _, other := range speakers {
+		if other != spk && other.Coordinator == spk && other.BondedTo != spk {
+			other.Coordinator = next
+		}
+	}
+}
+
+// groupMembers returns the visible players following coordinator spk.
+func groupMembers(spk *VirtualSpeaker, speakers []*VirtualSpeaker) []*VirtualSpeaker {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+
+	var members []*VirtualSpeaker
+	for _, other := range speakers {
+		if other != spk && other.Coordinator == spk && other.BondedTo == nil {
+			members = append(members, other)
+		}
+	}
+	return members
+}
+
+func splitSpec(spec, sep string) []string {
+	var parts []string
+	for _, p := range strings.Split(spec, sep) {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// zoneGroupState renders the household topology the way GetZoneGroupState
+// reports it on current firmware.
+func zoneGroupState(speakers []*VirtualSpeaker, localIP string) string {
+	topologyMu.Lock()
+	defer topologyMu.Unlock()
+
+	member := func(tag string, spk *VirtualSpeaker) string {
+		invisible := ""
+		if spk.BondedTo != nil {
+			invisible = ` Invisible="1"`
+		}
+		return fmt.Sprintf(`<%s UUID="%s" Location="http://%s:%d/xml/device_description.xml" ZoneName="%s"%s>`,
+			tag, spk.UUID, localIP, spk.Port, xmlEscape(spk.Name), invisible)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<ZoneGroupState><ZoneGroups>")
+	for _, c := range speakers {
+		if c.Coordinator != c || c.BondedTo != nil {
+			continue
+		}
+		fmt.Fprintf(&sb, `<ZoneGroup Coordinator="%s" ID="%s:1">`, c.UUID, c.UUID)
+		for _, spk := range speakers {
+			if spk.Coordinator != c || spk.BondedTo != nil {
+				continue
+			}
+			sb.WriteString(member("ZoneGroupMember", spk))
+			for _, sat := range spk.Satellites {
+				sb.WriteString(member("Satellite", sat))
+				sb.WriteString("</Satellite>")
+			}
+			sb.WriteString("</ZoneGroupMember>")
+		}
+		sb.WriteString("</ZoneGroup>")
+	}
+	sb.WriteString("</ZoneGroups><VanishedDevices></VanishedDevices></ZoneGroupState>")
+	return sb.String()
+}
+
+func handleZoneGroupTopology(w http.ResponseWriter, r *http.Request, speakers []*VirtualSpeaker, localIP string, spk *VirtualSpeaker) {
+	action := soapActionName(r)
+	if action != "GetZoneGroupState" {
+		log.Printf("[%s] Unknown ZoneGroupTopology action: %s", spk.Name, action)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[%s] GetZoneGroupState", spk.Name)
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Body>
+    <u:GetZoneGroupStateResponse xmlns:u="urn:schemas-upnp-org:service:ZoneGroupTopology:1">
+      <ZoneGroupState>%s</ZoneGroupState>
+    </u:GetZoneGroupStateResponse>
+  </s:Body>
+</s:Envelope>`, xmlEscape(zoneGroupState(speakers, localIP)))
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------- Transport State ---------------
+
+// transport is a player's simulated AVTransport and RenderingControl state.
+// Clips (plain http URLs) stop on their own after -clip-duration; queues and
+// streams play until told otherwise.
+type transport struct {
+	mu       sync.Mutex
+	state    string // PLAYING, PAUSED_PLAYBACK, STOPPED, NO_MEDIA_PRESENT
+	uri      string
+	metaData string
+	track    int
+	nrTracks int
+	offset   time.Duration // position when playback last started or paused
+	since    time.Time     // when the current PLAYING stretch began
+	volume   int
+	gen      int // bumped on every transport change, so stale clip timers do nothing
+}
+
+func newTransport(volume int) *transport {
+	return &transport{state: "NO_MEDIA_PRESENT", volume: volume}
+}
+
+// loadQueue puts the player in the middle of its queue, as if someone had
+// been listening to music before the gateway showed up.
+func (t *transport) loadQueue(uuid string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.uri = "x-rincon-queue:" + uuid + "#0"
+	t.metaData = ""
+	t.track = 3
+	t.nrTracks = 12
+	t.offset = 83 * time.Second
+	t.state = "PLAYING"
+	t.since = time.Now()
+	t.gen++
+}
+
+// loadSource puts the player on one of the sources -source names: "queue",
+// "radio", "tv", "line-in" or "idle". Inputs and streams have no tracks to
+// seek in.
+func (t *transport) loadSource(uuid, source string) error {
+	var uri string
+	switch source {
+	case "queue":
+		t.loadQueue(uuid)
+		return nil
+	case "radio":
+		uri = "x-sonosapi-stream:s12345?sid=254&flags=8224&sn=0"
+	case "tv":
+		uri = "x-sonos-htastream:" + uuid + ":spdif"
+	case "line-in":
+		uri = "x-rincon-stream:" + uuid
+	case "idle":
+	default:
+		return fmt.Errorf("unknown source %q, use queue, radio, tv, line-in or idle", source)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.uri = uri
+	t.metaData = ""
+	t.track = 1
+	t.nrTracks = 1
+	t.offset = 0
+	t.state = "PLAYING"
+	t.since = time.Now()
+	if uri == "" {
+		t.state = "NO_MEDIA_PRESENT"
+		t.nrTracks = 0
+	}
+	t.gen++
+	return nil
+}
+
+// positionLocked is the current offset into the track.
+func (t *transport) positionLocked() time.Duration {
+	if t.state == "PLAYING" {
+		return t.offset + time.Since(t.since)
+	}
+	return t.offset
+}
+
+func (t *transport) setURI(uri, metaData string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.uri = uri
+	t.metaData = metaData
+	t.track = 1
+	t.nrTracks = 1
+	if strings.HasPrefix(uri, "x-rincon-queue:") {
+		t.nrTracks = 12
+	}
+	t.offset = 0
+	t.state = "STOPPED"
+	t.gen++
+}
+
+// play starts playback and returns the generation a clip timer should check
+// before stopping the transport.
+func (t *transport) play() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != "PLAYING" {
+		t.state = "PLAYING"
+		t.since = time.Now()
+	}
+	t.gen++
+	return t.gen
+}
+
+func (t *transport) pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.offset = t.positionLocked()
+	t.state = "PAUSED_PLAYBACK"
+	t.gen++
+}
+
+func (t *transport) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.offset = 0
+	t.state = "STOPPED"
+	t.gen++
+}
+
+// finishClip stops the transport if nothing happened since the clip started.
+func (t *transport) finishClip(gen int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.gen != gen || t.state != "PLAYING" {
+		return false
+	}
+	t.offset = 0
+	t.state = "STOPPED"
+	t.gen++
+	return true
+}
+
+func (t *transport) seek(unit, target string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch unit {
+	case "TRACK_NR":
+		n, err := strconv.Atoi(target)
+		if err != nil || n < 1 || n > t.nrTracks {
+			return fmt.Errorf("bad track %q", target)
+		}
+		t.track = n
+		t.offset = 0
+	case "REL_TIME":
+		d, err := parseHMS(target)
+		if err != nil {
+			return err
+		}
+		t.offset = d
+	default:
+		return fmt.Errorf("unsupported seek unit %q", unit)
+	}
+	t.since = time.Now()
+	t.gen++
+	return nil
+}
+
+// trackURILocked is the URI of the current track; queue entries get a
+// made-up file name.
+func (t *transport) trackURILocked() string {
+	if strings.HasPrefix(t.uri, "x-rincon-queue:") {
+		return fmt.Sprintf("x-file-cifs://nas/music/track%02d.mp3", t.track)
+	}
+	return t.uri
+}
+
+// trackMetaDataLocked is the DIDL-Lite of the current track. Only a clip is
+// its own track; queue entries have none here.
+func (t *transport) trackMetaDataLocked() string {
+	if isClip(t.uri) {
+		return t.metaData
+	}
+	return ""
+}
+
+func (t *transport) trackDurationLocked() string {
+	if isClip(t.uri) {
+		return formatHMS(*clipDuration)
+	}
+	return "0:04:00"
+}
+
+// avTransportLastChange renders the AVTransport state as a LastChange
+// document.
+func (t *transport) avTransportLastChange() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf(`<Event xmlns="urn:schemas-upnp-org:metadata-1-0/AVT/"><InstanceID val="0">`+
+		`<TransportState val="%s"/><CurrentPlayMode val="NORMAL"/>`+
+		`<NumberOfTracks val="%d"/><CurrentTrack val="%d"/><CurrentTrackDuration val="%s"/>`+
+		`<CurrentTrackURI val="%s"/><AVTransportURI val="%s"/><AVTransportURIMetaData val="%s"/>`+
+		`</InstanceID></Event>`,
+		t.state, t.nrTracks, t.track, t.trackDurationLocked(),
+		xmlEscape(t.trackURILocked()), xmlEscape(t.uri), xmlEscape(t.metaData))
+}
+
+// renderingLastChange renders the RenderingControl state as a LastChange
+// document.
+func (t *transport) renderingLastChange() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf(`<Event xmlns="urn:schemas-upnp-org:metadata-1-0/RCS/"><InstanceID val="0">`+
+		`<Volume channel="Master" val="%d"/><Mute channel="Master" val="0"/>`+
+		`</InstanceID></Event>`, t.volume)
+}
+
+// isClip reports whether the URI is a one-off file, as announcements are.
+func isClip(uri string) bool {
+	return strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://")
+}
+
+// formatHMS formats a duration the way AVTransport reports positions.
+func formatHMS(d time.Duration) string {
+	s := int(d / time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+func parseHMS(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	var total int
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, fmt.Errorf("bad time %q", s)
+		}
+		total = total*60 + n
+	}
+	return time.Duration(total) * time.Second, nil
+}
+
+// --------------- RenderingControl ---------------
+
+func handleRenderingControl(w http.ResponseWriter, r *http.Request, spk *VirtualSpeaker) {
+	action := soapActionName(r)
+	body, _ := io.ReadAll(r.Body)
+	t := spk.Transport
+
+	var out string
+	switch action {
+	case "GetVolume":
+		t.mu.Lock()
+		out = fmt.Sprintf("<CurrentVolume>%d</CurrentVolume>", t.volume)
+		t.mu.Unlock()
+
+	case "SetVolume":
+		vol, err := strconv.Atoi(extractTagValue(string(body), "DesiredVolume"))
+		if err != nil || vol < 0 || vol > 100 {
+			writeSOAPFault(w, 402, "Invalid Args")
+			return
+		}
+		t.mu.Lock()
+		t.volume = vol
+		t.mu.Unlock()
+		log.Printf("[%s] SetVolume -> %d", spk.Name, vol)
+		defer spk.RenderingEvents.publish()
+
+	default:
+		log.Printf("[%s] Unknown RenderingControl action: %s", spk.Name, action)
+		writeSOAPFault(w, 401, "Invalid Action")
+		return
+	}
+	writeSOAPResponse(w, "urn:schemas-upnp-org:service:RenderingControl:1", action, out)
+}
+
+// --------------- SOAP Responses ---------------
+
+func writeSOAPResponse(w http.ResponseWriter, service, action, args string) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Body>
+    <u:%sResponse xmlns:u="%s">%s</u:%sResponse>
+  </s:Body>
+</s:Envelope>`, action, service, args, action)
+}
+
+// writeSOAPFault answers with a UPnP error, the way players reject actions
+// they cannot perform.
+func writeSOAPFault(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Body>
+    <s:Fault>
+      <faultcode>s:Client</faultcode>
+      <faultstring>UPnPError</faultstring>
+      <detail>
+        <UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+          <errorCode>%d</errorCode>
+          <errorDescription>%s</errorDescription>
+        </UPnPError>
+      </detail>
+    </s:Fault>
+  </s:Body>
+</s:Envelope>`, code, xmlEscape(description))
+}
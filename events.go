@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------- GENA Event Subscriptions ---------------
+
+const (
+	// eventSubscriptionTimeout is the lease we ask for; players may grant
+	// less. Leases are renewed once half of the granted time has passed.
+	eventSubscriptionTimeout = 30 * time.Minute
+	// eventCheckInterval is how often subscriptions are reconciled with the
+	// speakers map and renewed.
+	eventCheckInterval = 30 * time.Second
+	eventHTTPTimeout   = 5 * time.Second
+)
+
+// eventServices are the services whose events feed speakerStates.
+var eventServices = []string{"AVTransport", "RenderingControl"}
+
+// eventPort is the EVENT_PORT setting; 0 disables events. It is set once at
+// startup.
+var eventPort int
+
+// eventSubscription is one GENA subscription to one service of one speaker.
+type eventSubscription struct {
+	speaker *SonosSpeaker // copy taken when subscribing
+	service string
+	sid     string // empty while the SUBSCRIBE is in flight
+	granted time.Duration
+	expires time.Time
+	lastSeq int64
+}
+
+var (
+	// subscriptions is keyed by subscriptionKey, which is also the path of
+	// the callback URL, so a NOTIFY finds its subscription without a lookup
+	// by SID.
+	subscriptions   = make(map[string]*eventSubscription)
+	subscriptionsMu sync.Mutex
+)
+
+func subscriptionKey(speakerID, service string) string {
+	return speakerID + "/" + service
+}
+
+// startEventServer listens for NOTIFY callbacks on EVENT_PORT and keeps the
+// subscriptions of every speaker alive.
+func startEventServer(hosts []string) {
+	lns, err := listenAll(hosts, eventPort)
+	if err != nil {
+		log.Printf("Event callbacks disabled: %v", err)
+		return
+	}
+	for _, ln := range lns {
+		log.Printf("Starting event callback server on %s", ln.Addr())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events/", handleEventNotify)
+	go func() {
+		if err := serveAll(lns, mux); err != nil {
+			log.Printf("Event callback server error: %v", err)
+		}
+	}()
+
+	// The listener is up before the first SUBSCRIBE, so the initial event
+	// each player sends right away is not lost.
+	ticker := time.NewTicker(eventCheckInterval)
+	defer ticker.Stop()
+	for {
+		reconcileSubscriptions()
+		<-ticker.C
+	}
+}
+
+// reconcileSubscriptions subscribes to new speakers, renews leases that are
+// half used up, and drops subscriptions of speakers that left or moved.
+func reconcileSubscriptions() {
+	speakersMu.RLock()
+	current := make(map[string]*SonosSpeaker, len(speakers))
+	for id, s := range speakers {
+		c := *s
+		current[id] = &c
+	}
+	speakersMu.RUnlock()
+
+	var subscribe, renew, drop []*eventSubscription
+	now := time.Now()
+
+	subscriptionsMu.Lock()
+	for key, sub := range subscriptions {
+		s, ok := current[sub.speaker.ID]
+		if !ok || s.Location != sub.speaker.Location {
+			delete(subscriptions, key)
+			drop = append(drop, sub)
+			if !ok {
+				forgetSpeakerState(sub.speaker.ID)
+			}
+			continue
+		}
+		if sub.sid != "" && now.After(sub.expires.Add(-sub.granted/2)) {
+			renew = append(renew, sub)
+		}
+	}
+	for id, s := range current {
+		for _, service := range eventServices {
+			key := subscriptionKey(id, service)
+			if _, ok := subscriptions[key]; ok {
+				continue
+			}
+			sub := &eventSubscription{speaker: s, service: service, lastSeq: -1}
+			subscriptions[key] = sub
+			subscribe = append(subscribe, sub)
+		}
+	}
+	subscriptionsMu.Unlock()
+
+	for _, sub := range drop {
+		if sub.sid != "" {
+			go unsubscribeEvents(sub)
+		}
+	}
+	forEachParallel(len(renew), fanoutWorkers, func(i int) {
+		renewSubscription(renew[i])
+	})
+	forEachParallel(len(subscribe), fanoutWorkers, func(i int) {
+		subscribeEvents(subscribe[i])
+	})
+}
+
+// subscribeEvents sends a fresh SUBSCRIBE. On failure the placeholder is
+// removed so the next reconcile retries.
+func subscribeEvents(sub *eventSubscription) {
+	s := sub.speaker
+	key := subscriptionKey(s.ID, sub.service)
+	callback := fmt.Sprintf("http://%s/events/%s",
+		net.JoinHostPort(localIPFor(s), strconv.Itoa(eventPort)), key)
+
+	resp, err := genaRequest("SUBSCRIBE", s.eventURL(sub.service), map[string]string{
+		"CALLBACK": "<" + callback + ">",
+		"NT":       "upnp:event",
+		"TIMEOUT":  genaTimeout(eventSubscriptionTimeout),
+	})
+	if err == nil && resp.Header.Get("SID") == "" {
+		err = fmt.Errorf("SUBSCRIBE response without SID")
+	}
+
+	subscriptionsMu.Lock()
+	defer subscriptionsMu.Unlock()
+	if subscriptions[key] != sub {
+		return // dropped while subscribing
+	}
+	if err != nil {
+		log.Printf("Event subscription to %s %s failed: %v", s.Name, sub.service, err)
+		delete(subscriptions, key)
+		return
+	}
+	sub.sid = resp.Header.Get("SID")
+	sub.granted = parseGENATimeout(resp.Header.Get("TIMEOUT"))
+	sub.expires = time.Now().Add(sub.granted)
+	log.Printf("Subscribed to %s %s events (%s, %s)", s.Name, sub.service, sub.sid, sub.granted)
+}
+
+// renewSubscription extends a lease. A player that forgot the subscription
+// (e.g. after a reboot) answers 412, and we subscribe again.
+func renewSubscription(sub *eventSubscription) {
+	s := sub.speaker
+	subscriptionsMu.Lock()
+	sid := sub.sid
+	subscriptionsMu.Unlock()
+
+	resp, err := genaRequest("SUBSCRIBE", s.eventURL(sub.service), map[string]string{
+		"SID":     sid,
+		"TIMEOUT": genaTimeout(eventSubscriptionTimeout),
+	})
+
+	subscriptionsMu.Lock()
+	defer subscriptionsMu.Unlock()
+	key := subscriptionKey(s.ID, sub.service)
+	if subscriptions[key] != sub {
+		return
+	}
+	if err != nil {
+		log.Printf("Renewing %s %s events failed, resubscribing: %v", s.Name, sub.service, err)
+		// Dropping it makes the next reconcile subscribe afresh.
+		delete(subscriptions, key)
+		return
+	}
+	sub.granted = parseGENATimeout(resp.Header.Get("TIMEOUT"))
+	sub.expires = time.Now().Add(sub.granted)
+}
+
+func unsubscribeEvents(sub *eventSubscription) {
+	_, err := genaRequest("UNSUBSCRIBE", sub.speaker.eventURL(sub.service), map[string]string{"SID": sub.sid})
+	if err != nil {
+		log.Printf("Unsubscribing from %s %s events failed: %v", sub.speaker.Name, sub.service, err)
+	}
+}
+
+// genaRequest sends a SUBSCRIBE or UNSUBSCRIBE and fails on any status but
+// 200.
+func genaRequest(method, url string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := http.Client{Timeout: eventHTTPTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", method, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func genaTimeout(d time.Duration) string {
+	return fmt.Sprintf("Second-%d", int(d.Seconds()))
+}
+
+// parseGENATimeout reads a "Second-1800" TIMEOUT header. Missing, invalid
+// and "infinite" values fall back to what we asked for, so the lease is
+// still renewed regularly.
+func parseGENATimeout(v string) time.Duration {
+	secs, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(v), "Second-"))
+	if err != nil || secs <= 0 {
+		return eventSubscriptionTimeout
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// handleEventNotify receives the NOTIFY a player sends for each state change
+// at /events/{speakerID}/{service}.
+func handleEventNotify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "NOTIFY" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("NT") != "upnp:event" || r.Header.Get("NTS") != "upnp:propchange" {
+		http.Error(w, "Bad event", http.StatusBadRequest)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/events/")
+	sid := r.Header.Get("SID")
+	seq, err := strconv.ParseInt(r.Header.Get("SEQ"), 10, 64)
+	if err != nil {
+		http.Error(w, "Bad SEQ", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad body", http.StatusBadRequest)
+		return
+	}
+
+	subscriptionsMu.Lock()
+	sub, ok := subscriptions[key]
+	// The initial event may beat the SUBSCRIBE response that tells us the SID.
+	if !ok || (sub.sid != "" && sub.sid != sid) {
+		subscriptionsMu.Unlock()
+		http.Error(w, "Unknown subscription", http.StatusPreconditionFailed)
+		return
+	}
+	// SEQ 0 is the initial event; anything older than what we have is stale.
+	stale := seq != 0 && seq <= sub.lastSeq
+	if !stale {
+		sub.lastSeq = seq
+	}
+	speakerID := sub.speaker.ID
+	subscriptionsMu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	if stale {
+		return
+	}
+
+	changes, err := parseEventBody(body)
+	if err != nil {
+		log.Printf("Event from %s: %v", key, err)
+		return
+	}
+	applyStateChanges(speakerID, changes)
+}
+
+// parseEventBody extracts the LastChange state changes from a GENA property
+// set.
+func parseEventBody(body []byte) ([]stateChange, error) {
+	var ps struct {
+		Properties []struct {
+			LastChange string `xml:"LastChange"`
+		} `xml:"property"`
+	}
+	if err := xml.Unmarshal(body, &ps); err != nil {
+		return nil, fmt.Errorf("propertyset: %w", err)
+	}
+	var changes []stateChange
+	for _, p := range ps.Properties {
+		if p.LastChange == "" {
+			continue
+		}
+		c, err := parseLastChange(p.LastChange)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c...)
+	}
+	return changes, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// --------------- Announcement Fan-out ---------------
+
+// defaultFanoutWorkers bounds how many speakers are talked to at once.
+const defaultFanoutWorkers = 8
+
+// bufferDelay gives every player time to start fetching the clip between the
+// prepare and the play phase.
+const bufferDelay = 300 * time.Millisecond
+
+// fanoutWorkers is the FANOUT_WORKERS setting.
+var fanoutWorkers = defaultFanoutWorkers
+
+// speakerPlayback is one target of an announcement as it moves through the
+// prepare, play and restore phases.
+type speakerPlayback struct {
+	speaker  *SonosSpeaker
+	mediaURL string
+	metaData string
+	volume   int
+
+	// members are the other players of the speaker's group, which play the
+	// clip with it but keep their own volume.
+	members []*memberVolume
+
+	snap     *playbackSnapshot
+	source   string // what the speaker was doing, from the snapshot
+	skipped  string // why the interrupt policy kept the clip off it
+	prepared bool
+	err      error
+	progress clipProgress
+}
+
+// memberVolume is a group member whose volume an announcement on its
+// coordinator changes.
+type memberVolume struct {
+	speaker *SonosSpeaker
+	volume  int // announcement volume, noVolume to leave it
+	prev    int // volume before the announcement, noVolume if unknown
+}
+
+// targetMembersLocked returns copies of the online members of each target's
+// group, in the order of targets. The caller must hold speakersMu for
+// reading.
+func targetMembersLocked(targets []*SonosSpeaker) [][]*SonosSpeaker {
+	members := make([][]*SonosSpeaker, len(targets))
+	for i, c := range targets {
+		for _, m := range groupMembersLocked(c) {
+			if !m.Online {
+				continue
+			}
+			cp := *m
+			members[i] = append(members[i], &cp)
+		}
+	}
+	return members
+}
+
+// targetMembers is targetMembersLocked for callers not holding speakersMu.
+func targetMembers(targets []*SonosSpeaker) [][]*SonosSpeaker {
+	speakersMu.RLock()
+	defer speakersMu.RUnlock()
+	return targetMembersLocked(targets)
+}
+
+// playAll announces on every target concurrently. All players are prepared
+// first (snapshot, volume, SetAVTransportURI), then Play is fired on all of
+// them together so rooms start within a few milliseconds of each other.
+// Finally each player is restored as soon as its own clip ends. The results
+// report when each clip started and finished. Cancelling ctx cuts the clips
+// short; the restore still runs. Each speaker is registered with stops, so
+// it can be stopped by itself.
+func playAll(ctx context.Context, plays []*speakerPlayback, stops *speakerStops) ([]playbackResult, error) {
+	ctxs := make([]context.Context, len(plays))
+	ends := make([]func(), len(plays))
+	for i, p := range plays {
+		ctxs[i], ends[i] = stops.begin(ctx, p.speaker.ID)
+	}
+
+	forEachParallel(len(plays), fanoutWorkers, func(i int) { plays[i].prepare(ctxs[i]) })
+
+	ready := 0
+	for _, p := range plays {
+		if p.prepared {
+			ready++
+		}
+	}
+	if ready > 0 && sleepContext(ctx, bufferDelay) == nil {
+		forEachParallel(len(plays), fanoutWorkers, func(i int) { plays[i].start(ctxs[i]) })
+	}
+
+	// Waiting is mostly sleeping between polls; one slow clip must not hold
+	// up the restore of the others, so this phase is not bounded.
+	forEachParallel(len(plays), len(plays), func(i int) {
+		plays[i].finish(ctxs[i])
+		ends[i]()
+	})
+
+	results := make([]playbackResult, len(plays))
+	var errs []error
+	for i, p := range plays {
+		results[i] = newPlaybackResult(p.speaker, p.progress)
+		results[i].Source = p.source
+		if p.err != nil {
+			log.Printf("Error playing on %s: %v", p.speaker.Name, p.err)
+			errs = append(errs, fmt.Errorf("%s: %w", p.speaker.Name, p.err))
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// forEachParallel calls fn for 0..n-1 with at most limit calls in flight,
+// and returns when all of them have.
+func forEachParallel(n, limit int, fn func(i int)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// sleepContext sleeps for d or until ctx is done, whichever comes first, and
+// returns ctx.Err() in the latter case.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopClip stops a clip that was cut short, so it does not play on while
+// the restore runs, or at all when there was nothing to restore.
+func stopClip(ctx context.Context, s *SonosSpeaker) {
+	if err := stop(ctx, s); err != nil {
+		log.Printf("Stopping the clip on %s failed: %v", s.Name, err)
+	}
+}
+
+func (p *speakerPlayback) prepare(ctx context.Context) {
+	s := p.speaker
+
+	// Without a snapshot the source is unknown and may be an input, so only
+	// policyInterrupt plays over it, with nothing to restore.
+	policy := interruptPolicyFor(s)
+	snap, err := takeSnapshot(ctx, s)
+	switch {
+	case err != nil && policy != policyInterrupt:
+		p.err = fmt.Errorf("snapshot failed, source unknown: %w", err)
+		return
+	case err != nil:
+		log.Printf("Snapshot of %s failed, its playback will not be restored: %v", s.Name, err)
+	default:
+		p.source = classifySource(snap)
+		if p.skipped = skipReason(policy, p.source); p.skipped != "" {
+			log.Printf("Skipping %s: %s", s.Name, p.skipped)
+			return
+		}
+	}
+	p.snap = snap
+
+	// Only change a volume we know how to put back.
+	if p.volume != noVolume && snap != nil && snap.HasVolume && p.volume != snap.Volume {
+		if err := setVolume(ctx, s, p.volume); err != nil {
+			log.Printf("Setting announcement volume on %s failed: %v", s.Name, err)
+		}
+	}
+	// Volume is per player, even within a group.
+	for _, m := range p.members {
+		if m.volume == noVolume {
+			continue
+		}
+		vol, err := getVolume(ctx, m.speaker)
+		if err != nil || vol == m.volume {
+			continue
+		}
+		m.prev = vol
+		if err := setVolume(ctx, m.speaker, m.volume); err != nil {
+			log.Printf("Setting announcement volume on %s failed: %v", m.speaker.Name, err)
+		}
+	}
+
+	if err := setClipURI(ctx, s, p.mediaURL, p.metaData); err != nil {
+		p.err = err
+		return
+	}
+	p.prepared = true
+}
+
+func (p *speakerPlayback) start(ctx context.Context) {
+	if !p.prepared {
+		return
+	}
+	if p.err = startPlayback(ctx, p.speaker); p.err == nil {
+		p.progress.Started = time.Now()
+	}
+}
+
+// finish waits for the clip to end and restores the snapshot. A speaker
+// whose clip never started is restored right away.
+func (p *speakerPlayback) finish(ctx context.Context) {
+	switch {
+	case p.skipped != "":
+		p.progress = clipProgress{Status: clipSkipped, Err: errors.New(p.skipped)}
+	case !p.progress.Started.IsZero():
+		p.progress = trackClip(ctx, p.speaker, p.mediaURL, p.progress.Started)
+	case ctx.Err() != nil:
+		p.err = context.Cause(ctx)
+		p.progress = clipProgress{Status: clipCancelled, Err: p.err}
+	default:
+		p.progress = clipProgress{Status: clipFailed, Err: p.err}
+	}
+	if p.progress.Status == clipCancelled && !p.progress.Started.IsZero() {
+		stopClip(context.WithoutCancel(ctx), p.speaker)
+	}
+	// The restore must happen even when the caller has gone away.
+	ctx = context.WithoutCancel(ctx)
+	if p.snap != nil {
+		if err := restoreSnapshot(ctx, p.speaker, p.snap); err != nil {
+			log.Printf("Restoring playback on %s failed: %v", p.speaker.Name, err)
+		}
+	}
+	for _, m := range p.members {
+		if m.prev == noVolume {
+			continue
+		}
+		if err := setVolume(ctx, m.speaker, m.prev); err != nil {
+			log.Printf("Restoring volume on %s failed: %v", m.speaker.Name, err)
+		}
+	}
+}
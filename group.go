@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// --------------- Group Announcements ---------------
+
+// How an announcement reaches several zone groups.
+const (
+	// modeParallel plays the clip on every group coordinator at once.
+	modeParallel = "parallel"
+	// modeGroup temporarily joins every target to one coordinator, so the
+	// players stay sample-accurate, then restores the original groups.
+	modeGroup = "group"
+)
+
+// defaultAnnounceMode is the ANNOUNCE_MODE setting.
+var defaultAnnounceMode = modeParallel
+
+// parseAnnounceMode validates a mode name; empty selects the default.
+func parseAnnounceMode(mode string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(mode)); m {
+	case "":
+		return defaultAnnounceMode, nil
+	case modeParallel, modeGroup:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown announcement mode %q, use %q or %q", mode, modeParallel, modeGroup)
+	}
+}
+
+// loadAnnounceMode reads ANNOUNCE_MODE, "parallel" (default) or "group".
+func loadAnnounceMode() string {
+	v := os.Getenv("ANNOUNCE_MODE")
+	if v == "" {
+		return modeParallel
+	}
+	mode, err := parseAnnounceMode(v)
+	if err != nil {
+		log.Printf("Invalid ANNOUNCE_MODE: %v, using %s", err, modeParallel)
+		return modeParallel
+	}
+	return mode
+}
+
+// groupParticipant is one player taking part in a grouped announcement.
+type groupParticipant struct {
+	speaker *SonosSpeaker
+	// coordinator is the player's original group coordinator, nil when the
+	// player coordinated its own group.
+	coordinator *SonosSpeaker
+	volume      int // announcement volume, noVolume to leave it
+
+	snap       *playbackSnapshot // coordinators only
+	prevVolume int               // members only, noVolume if unknown
+	source     string            // what the player's group was doing
+	skipped    string            // why the interrupt policy left its group out
+	moved      bool
+	// err is why the player took no part: its group's source could not be
+	// checked, or it could not join.
+	err error
+}
+
+// groupParticipantsLocked expands the target coordinators into every player
+// of their groups. The first target leads the announcement group. Members
+// known to be offline are left out. The caller must hold speakersMu for
+// reading.
+func groupParticipantsLocked(targets []*SonosSpeaker) []*groupParticipant {
+	var parts []*groupParticipant
+	for _, c := range targets {
+		parts = append(parts, &groupParticipant{speaker: c})
+		for _, m := range groupMembersLocked(c) {
+			if !m.Online {
+				log.Printf("Skipping offline speaker %s", m.Name)
+				continue
+			}
+			parts = append(parts, &groupParticipant{speaker: m, coordinator: c})
+		}
+	}
+	return parts
+}
+
+// playGrouped joins every participant to the first one, plays the clip once
+// on that coordinator and then puts every player back in its own group,
+// playing what it played before. Groups the interrupt policy rules out are
+// left alone, as are groups whose source cannot be checked against it, and
+// the first remaining coordinator leads. Every player reports the leader's
+// progress, except those that took no part.
+func playGrouped(ctx context.Context, parts []*groupParticipant, c clip) ([]playbackResult, error) {
+	// Snapshot the coordinators' playback and the members' volumes.
+	forEachParallel(len(parts), fanoutWorkers, func(i int) {
+		p := parts[i]
+		p.prevVolume = noVolume
+		if p.coordinator == nil {
+			policy := interruptPolicyFor(p.speaker)
+			snap, err := takeSnapshot(ctx, p.speaker)
+			switch {
+			case err != nil && policy != policyInterrupt:
+				log.Printf("Snapshot of %s failed, leaving its group out: %v", p.speaker.Name, err)
+				p.err = fmt.Errorf("snapshot failed, source unknown: %w", err)
+				return
+			case err != nil:
+				log.Printf("Snapshot of %s failed, its playback will not be restored: %v", p.speaker.Name, err)
+			default:
+				p.source = classifySource(snap)
+				if p.skipped = skipReason(policy, p.source); p.skipped != "" {
+					log.Printf("Skipping %s and its group: %s", p.speaker.Name, p.skipped)
+					return
+				}
+			}
+			p.snap = snap
+			return
+		}
+		if vol, err := getVolume(ctx, p.speaker); err == nil {
+			p.prevVolume = vol
+		}
+	})
+
+	// Members share their coordinator's fate.
+	coordinators := make(map[string]*groupParticipant)
+	for _, p := range parts {
+		if p.coordinator == nil {
+			coordinators[p.speaker.ID] = p
+		}
+	}
+	var leader *SonosSpeaker
+	joining := 0
+	for _, p := range parts {
+		if p.coordinator != nil {
+			if c := coordinators[p.coordinator.ID]; c != nil {
+				p.source, p.skipped, p.err = c.source, c.skipped, c.err
+			}
+		}
+		if p.skipped != "" || p.err != nil {
+			p.prevVolume = noVolume
+			continue
+		}
+		joining++
+		if leader == nil && p.coordinator == nil {
+			leader = p.speaker
+		}
+	}
+	if leader == nil {
+		return groupResults(parts, clipProgress{}), groupErrors(parts, nil)
+	}
+	log.Printf("Grouping %d players under %s for the announcement", joining, leader.Name)
+
+	// Join everyone not already following the leader.
+	var errs []error
+	forEachParallel(len(parts), fanoutWorkers, func(i int) {
+		p := parts[i]
+		if p.skipped != "" || p.err != nil || p.speaker.ID == leader.ID || (p.coordinator != nil && p.coordinator.ID == leader.ID) {
+			return
+		}
+		if err := joinGroup(ctx, p.speaker, leader); err != nil {
+			log.Printf("%s could not join %s: %v", p.speaker.Name, leader.Name, err)
+			p.err = err
+			return
+		}
+		p.moved = true
+	})
+
+	// Volume is per player, even within a group.
+	forEachParallel(len(parts), fanoutWorkers, func(i int) {
+		p := parts[i]
+		if p.skipped != "" || p.err != nil || p.volume == noVolume {
+			return
+		}
+		prev := p.prevVolume
+		if p.snap != nil && p.snap.HasVolume {
+			prev = p.snap.Volume
+		}
+		if prev == noVolume || prev == p.volume {
+			return
+		}
+		if err := setVolume(ctx, p.speaker, p.volume); err != nil {
+			log.Printf("Setting announcement volume on %s failed: %v", p.speaker.Name, err)
+		}
+	})
+
+	mediaURL := c.url(leader)
+	err := setClipURI(ctx, leader, mediaURL, c.didl(mediaURL))
+	if err == nil {
+		err = sleepContext(ctx, bufferDelay)
+	}
+	if err == nil {
+		err = startPlayback(ctx, leader)
+	}
+	var progress clipProgress
+	switch {
+	case err == nil:
+		progress = trackClip(ctx, leader, mediaURL, time.Now())
+	case ctx.Err() != nil:
+		progress = clipProgress{Status: clipCancelled, Err: context.Cause(ctx)}
+	default:
+		progress = clipProgress{Status: clipFailed, Err: err}
+		errs = append(errs, fmt.Errorf("%s: %w", leader.Name, err))
+	}
+	if progress.Status == clipCancelled && !progress.Started.IsZero() {
+		stopClip(context.WithoutCancel(ctx), leader)
+	}
+
+	// Put the groups back even when the caller has gone away.
+	restoreGroups(context.WithoutCancel(ctx), parts)
+	refreshTopology()
+
+	return groupResults(parts, progress), groupErrors(parts, errs)
+}
+
+// groupErrors adds the players that took no part to errs and logs them all.
+func groupErrors(parts []*groupParticipant, errs []error) error {
+	for _, p := range parts {
+		if p.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.speaker.Name, p.err))
+		}
+	}
+	for _, e := range errs {
+		log.Printf("Error playing on group: %v", e)
+	}
+	return errors.Join(errs...)
+}
+
+// groupResults reports the leader's progress for every player that took
+// part in a grouped announcement.
+func groupResults(parts []*groupParticipant, progress clipProgress) []playbackResult {
+	results := make([]playbackResult, len(parts))
+	for i, p := range parts {
+		switch {
+		case p.skipped != "":
+			results[i] = newPlaybackResult(p.speaker, clipProgress{Status: clipSkipped, Err: errors.New(p.skipped)})
+		case p.err != nil:
+			results[i] = newPlaybackResult(p.speaker, clipProgress{Status: clipFailed, Err: p.err})
+		default:
+			results[i] = newPlaybackResult(p.speaker, progress)
+		}
+		results[i].Source = p.source
+	}
+	return results
+}
+
+// restoreGroups undoes playGrouped: moved coordinators leave the
+// announcement group first, so their members can rejoin them, then every
+// coordinator gets its playback back and every member its volume.
+func restoreGroups(ctx context.Context, parts []*groupParticipant) {
+	forEachParallel(len(parts), fanoutWorkers, func(i int) {
+		p := parts[i]
+		if p.moved && p.coordinator == nil {
+			if err := leaveGroup(ctx, p.speaker); err != nil {
+				log.Printf("%s could not leave the announcement group: %v", p.speaker.Name, err)
+			}
+		}
+	})
+
+	forEachParallel(len(parts), fanoutWorkers, func(i int) {
+		p := parts[i]
+		if p.moved && p.coordinator != nil {
+			if err := joinGroup(ctx, p.speaker, p.coordinator); err != nil {
+				log.Printf("%s could not rejoin %s: %v", p.speaker.Name, p.coordinator.Name, err)
+			}
+		}
+	})
+
+	forEachParallel(len(parts), fanoutWorkers, func(i int) {
+		p := parts[i]
+		switch {
+		case p.snap != nil:
+			if err := restoreSnapshot(ctx, p.speaker, p.snap); err != nil {
+				log.Printf("Restoring playback on %s failed: %v", p.speaker.Name, err)
+			}
+		case p.prevVolume != noVolume:
+			if err := setVolume(ctx, p.speaker, p.prevVolume); err != nil {
+				log.Printf("Restoring volume on %s failed: %v", p.speaker.Name, err)
+			}
+		}
+	})
+}
+
+// joinGroup makes s a member of coordinator's group by pointing its
+// transport at the coordinator.
+func joinGroup(ctx context.Context, s, coordinator *SonosSpeaker) error {
+	return setClipURI(ctx, s, "x-rincon:"+coordinator.ID, "")
+}
+
+// leaveGroup takes s out of its group and makes it a standalone player.
+func leaveGroup(ctx context.Context, s *SonosSpeaker) error {
+	return s.invoke(ctx, avTransportService, "BecomeCoordinatorOfStandaloneGroup", instanceArgs{}, nil)
+}
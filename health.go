@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --------------- Speaker Health ---------------
+
+const (
+	// healthFailLimit is how many consecutive failed probes mark a speaker
+	// offline, so one dropped packet does not flap it.
+	healthFailLimit = 2
+	healthTimeout   = 2 * time.Second
+)
+
+// runHealthChecks probes every speaker each interval and tracks whether it is
+// reachable. An interval of zero or less disables it.
+func runHealthChecks(interval time.Duration) {
+	if interval <= 0 {
+		log.Println("Speaker health checks disabled")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkSpeakerHealth()
+	}
+}
+
+// checkSpeakerHealth probes all speakers in parallel without holding
+// speakersMu, then records the results.
+func checkSpeakerHealth() {
+	speakersMu.RLock()
+	urls := make(map[string]string, len(speakers))
+	for id, s := range speakers {
+		urls[id] = s.descriptionURL()
+	}
+	speakersMu.RUnlock()
+
+	results := make(map[string]error, len(urls))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for id, url := range urls {
+		wg.Add(1)
+		go func(id, url string) {
+			defer wg.Done()
+			err := probeSpeaker(url)
+			mu.Lock()
+			results[id] = err
+			mu.Unlock()
+		}(id, url)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	speakersMu.Lock()
+	defer speakersMu.Unlock()
+	for id, err := range results {
+		// The speaker may have been removed or re-added while we probed.
+		if s, ok := speakers[id]; ok && s.descriptionURL() == urls[id] {
+			recordHealthLocked(s, err, now)
+		}
+	}
+}
+
+// probeSpeaker fetches the device description; any answer means the player
+// is up.
+func probeSpeaker(descriptionURL string) error {
+	client := http.Client{Timeout: healthTimeout}
+	resp, err := client.Get(descriptionURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// descriptionURL returns the description URL the speaker was found with,
+// or the standard Sonos path on its base URL if none was recorded.
+func (s *SonosSpeaker) descriptionURL() string {
+	if s.DescriptionURL != "" {
+		return s.DescriptionURL
+	}
+	return s.Location + "/xml/device_description.xml"
+}
+
+// recordHealthLocked applies one probe result. The caller must hold
+// speakersMu for writing.
+func recordHealthLocked(s *SonosSpeaker, err error, now time.Time) {
+	if err == nil {
+		if !s.Online {
+			log.Printf("Speaker online: %s (id: %s)", s.Name, s.ID)
+		}
+		s.Online = true
+		s.Failures = 0
+		s.LastError = ""
+		s.LastSeen = now
+		return
+	}
+
+	s.Failures++
+	s.LastError = err.Error()
+	if s.Online && s.Failures >= healthFailLimit {
+		log.Printf("Speaker offline: %s (id: %s) after %d failed checks: %v", s.Name, s.ID, s.Failures, err)
+		s.Online = false
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// --------------- Network Interfaces ---------------
+
+// ssdpInterface is one local IPv4 address that SSDP searches go out from.
+type ssdpInterface struct {
+	Name  string
+	IP    net.IP
+	IPNet *net.IPNet
+}
+
+func (i ssdpInterface) String() string {
+	if i.IP == nil {
+		return "default route"
+	}
+	return i.Name + " (" + i.IP.String() + ")"
+}
+
+// ssdpInterfaces lists the IPv4 addresses to run discovery on: the
+// interfaces named in SSDP_INTERFACES (comma-separated), or otherwise every
+// interface that is up, multicast-capable and not loopback.
+func ssdpInterfaces() []ssdpInterface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("Cannot list network interfaces: %v", err)
+		return nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(os.Getenv("SSDP_INTERFACES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			wanted[name] = true
+		}
+	}
+
+	var result []ssdpInterface
+	for _, ifi := range ifaces {
+		if len(wanted) > 0 {
+			if !wanted[ifi.Name] {
+				continue
+			}
+		} else if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			result = append(result, ssdpInterface{Name: ifi.Name, IP: ipNet.IP.To4(), IPNet: ipNet})
+		}
+	}
+	return result
+}
+
+// localIPFor picks the address speakers should use to reach us: the
+// LOCAL_IP override if set, else our address on the speaker's subnet, else
+// the default local IP.
+func localIPFor(s *SonosSpeaker) string {
+	if ip := os.Getenv("LOCAL_IP"); ip != "" {
+		return ip
+	}
+	if u, err := url.Parse(s.Location); err == nil {
+		if speakerIP := net.ParseIP(u.Hostname()); speakerIP != nil {
+			for _, ifc := range ssdpInterfaces() {
+				if ifc.IPNet.Contains(speakerIP) {
+					return ifc.IP.String()
+				}
+			}
+		}
+	}
+	if localIP == "" {
+		// The host had no network at startup; look again.
+		return getLocalIP()
+	}
+	return localIP
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,10 +26,36 @@ var swaggerSpec []byte
 // SonosSpeaker represents a discovered Sonos speaker.
 type SonosSpeaker struct {
 	Name     string
-	ID       string
+	ID       string // device UUID from the UDN, e.g. RINCON_000E58A1B2C301400
+	Alias    string // normalized room name (lowercase, no spaces), e.g. livingroom
 	Location string // base URL e.g. http://192.168.1.10:1400
+	Source   string // sourceDiscovery or sourceConfig
+
+	// DescriptionURL is the device description the speaker was found or
+	// configured with, e.g. a custom static path or an mDNS TXT location.
+	DescriptionURL string
+
+	// Device metadata from the description XML.
+	Model           string
+	ModelNumber     string
+	SerialNum       string
+	SoftwareVersion string
+	HardwareVersion string
+	Services        map[string]upnpService // by short name, e.g. "AVTransport"
+
+	LastSeen time.Time
+	Expires  time.Time // SSDP max-age deadline from the last sighting; zero if none was advertised
+
+	// Reachability from discovery and health checks, guarded by speakersMu.
+	Online    bool
+	Failures  int // consecutive failed health checks
+	LastError string
+
+	missedScans int // consecutive discovery scans without a response, guarded by speakersMu
 }
 
+var errSpeakerNotFound = errors.New("speaker not found")
+
 var (
 	speakers   map[string]*SonosSpeaker
 	speakersMu sync.RWMutex
@@ -38,15 +64,70 @@ var (
 
 func main() {
 	os.MkdirAll("./tts", 0755)
+	os.MkdirAll("./"+chimeDir, 0755)
+	os.MkdirAll("./"+mediaDir, 0755)
 
 	localIP = getLocalIP()
-	log.Printf("Local IP: %s", localIP)
+	if localIP != "" {
+		log.Printf("Local IP: %s", localIP)
+	} else {
+		log.Println("No local IP found yet; media URLs use the address facing each speaker")
+	}
+
+	// Settings are read once here and not changed while running.
+	discoveryBackends = loadDiscoveryBackends()
+	staticSpeakers = loadStaticSpeakers()
+	if len(staticSpeakers) > 0 {
+		log.Printf("Configured speakers: %s", strings.Join(staticSpeakers, ", "))
+	}
+	defaultAnnounceVolume, announceVolumes = loadAnnounceVolumes()
+	defaultAnnounceMode = loadAnnounceMode()
+	if fanoutWorkers = envInt("FANOUT_WORKERS", defaultFanoutWorkers); fanoutWorkers < 1 {
+		fanoutWorkers = 1
+	}
+	if soapTimeout = envDuration("SOAP_TIMEOUT", defaultSOAPTimeout); soapTimeout <= 0 {
+		soapTimeout = defaultSOAPTimeout
+	}
+	if soapRetries = envInt("SOAP_RETRIES", defaultSOAPRetries); soapRetries < 0 {
+		soapRetries = 0
+	}
+	if announceExpiry = envDuration("ANNOUNCE_EXPIRY", defaultAnnounceExpiry); announceExpiry <= 0 {
+		announceExpiry = defaultAnnounceExpiry
+	}
+	defaultChime, priorityChimes = loadAnnounceChimes()
+	defaultInterruptPolicy, interruptPolicies = loadInterruptPolicies()
+	playback = loadPlaybackBackend()
+	log.Printf("Playback backend: %s", playback.name())
+	if tts, ttsErr = loadTTSEngine(); ttsErr != nil {
+		log.Printf("ERROR: text-to-speech is disabled, /speak and Telegram announcements will fail: %v", ttsErr)
+	} else {
+		log.Printf("TTS engine: %s", tts.name())
+	}
+	clipEncoder = findClipEncoder()
+	if clipEncoder == "" {
+		log.Println("No audio encoder found (afconvert, ffmpeg or lame); speech is served uncompressed")
+	}
 
-	speakers = discoverSonos()
+	speakers = make(map[string]*SonosSpeaker)
+	applyDiscovery(scanSpeakers())
+	refreshTopology()
 	logSpeakers()
 
-	go startFileServer(localIP)
-	go startAPIServer(localIP)
+	go runDiscovery(envDuration("DISCOVERY_INTERVAL", 5*time.Minute))
+	go runHealthChecks(envDuration("HEALTH_INTERVAL", 30*time.Second))
+	go runTopologyRefresh()
+	if discoveryBackendEnabled(backendSSDP) {
+		go listenSSDPNotify()
+	}
+	go expireSpeakers()
+	hosts := listenHosts()
+	go startFileServer(hosts)
+	go startAPIServer(hosts)
+	if eventPort = envInt("EVENT_PORT", 3400); eventPort > 0 {
+		go startEventServer(hosts)
+	} else {
+		log.Println("Speaker events disabled")
+	}
 
 	log.Println("Sonos Gateway Ready")
 	startTelegramBot()
@@ -54,32 +135,213 @@ func main() {
 
 // --------------- Network helpers ---------------
 
+// getLocalIP returns the LOCAL_IP override, the address of the default
+// route, or the first multicast interface address, in that order. It returns
+// "" on a host with no usable network instead of failing.
 func getLocalIP() string {
 	if ip := os.Getenv("LOCAL_IP"); ip != "" {
 		return ip
 	}
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if conn, err := net.Dial("udp", "8.8.8.8:80"); err == nil {
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	}
+	if ifaces := ssdpInterfaces(); len(ifaces) > 0 {
+		return ifaces[0].IP.String()
+	}
+	return ""
+}
+
+// listenHosts are the addresses the HTTP servers bind to: the LOCAL_IP
+// override if set, otherwise the detected LAN address and our address on
+// every multicast interface, so speakers on any subnet can fetch media
+// without the servers listening on every interface. Loopback is the last
+// resort on a host with no network.
+func listenHosts() []string {
+	if ip := os.Getenv("LOCAL_IP"); ip != "" {
+		return []string{ip}
+	}
+	var hosts []string
+	seen := make(map[string]bool)
+	add := func(ip string) {
+		if ip != "" && !seen[ip] {
+			seen[ip] = true
+			hosts = append(hosts, ip)
+		}
+	}
+	add(localIP)
+	for _, ifc := range ssdpInterfaces() {
+		add(ifc.IP.String())
+	}
+	if len(hosts) == 0 {
+		log.Println("No LAN address found, listening on loopback only")
+		add("127.0.0.1")
+	}
+	return hosts
+}
+
+// listenAll listens on port at every host. Addresses that cannot be bound,
+// e.g. an interface that went away after startup, are logged and skipped; it
+// fails only if none can be.
+func listenAll(hosts []string, port int) ([]net.Listener, error) {
+	var lns []net.Listener
+	var lastErr error
+	for _, host := range hosts {
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			log.Printf("Skipping listen address: %v", err)
+			lastErr = err
+			continue
+		}
+		lns = append(lns, ln)
+	}
+	if len(lns) == 0 {
+		return nil, lastErr
+	}
+	return lns, nil
+}
+
+// serveAll serves handler on every listener and returns the first error.
+func serveAll(lns []net.Listener, handler http.Handler) error {
+	errc := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) { errc <- http.Serve(ln, handler) }(ln)
+	}
+	return <-errc
+}
+
+// --------------- Config helpers ---------------
+
+// envDuration parses a Go duration (e.g. "90s", "5m") from the named
+// environment variable, falling back to def when unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
 	if err != nil {
-		log.Fatal("Failed to detect local IP:", err)
+		log.Printf("Invalid %s %q, using %s: %v", name, v, def, err)
+		return def
 	}
-	defer conn.Close()
-	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	return d
+}
+
+// envInt parses an integer from the named environment variable, falling
+// back to def when unset or invalid.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %d: %v", name, v, def, err)
+		return def
+	}
+	return n
 }
 
 // --------------- SSDP / UPnP Discovery ---------------
 
 type deviceDescription struct {
-	XMLName xml.Name `xml:"root"`
-	Device  struct {
-		RoomName    string `xml:"roomName"`
-		DisplayName string `xml:"displayName"`
-		ModelName   string `xml:"modelName"`
-	} `xml:"device"`
+	XMLName xml.Name   `xml:"root"`
+	Device  upnpDevice `xml:"device"`
 }
 
+type upnpDevice struct {
+	DeviceType      string        `xml:"deviceType"`
+	UDN             string        `xml:"UDN"`
+	RoomName        string        `xml:"roomName"`
+	DisplayName     string        `xml:"displayName"`
+	ModelName       string        `xml:"modelName"`
+	ModelNumber     string        `xml:"modelNumber"`
+	SerialNum       string        `xml:"serialNum"`
+	SoftwareVersion string        `xml:"softwareVersion"`
+	HardwareVersion string        `xml:"hardwareVersion"`
+	Services        []upnpService `xml:"serviceList>service"`
+	Devices         []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType" json:"type"`
+	ServiceID   string `xml:"serviceId" json:"-"`
+	ControlURL  string `xml:"controlURL" json:"control_url"`
+	EventSubURL string `xml:"eventSubURL" json:"event_sub_url"`
+	SCPDURL     string `xml:"SCPDURL" json:"scpd_url"`
+}
+
+// discoverSonos runs the enabled discovery backends in parallel and fetches
+// the device description of every player they found.
 func discoverSonos() map[string]*SonosSpeaker {
 	result := make(map[string]*SonosSpeaker)
 
+	found := make(map[string]discoveredLocation)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	run := func(search func() map[string]discoveredLocation) {
+		defer wg.Done()
+		locations := search()
+		mu.Lock()
+		for loc, r := range locations {
+			found[loc] = r
+		}
+		mu.Unlock()
+	}
+	if discoveryBackendEnabled(backendSSDP) {
+		wg.Add(1)
+		go run(ssdpDiscover)
+	}
+	if discoveryBackendEnabled(backendMDNS) {
+		wg.Add(1)
+		go run(mdnsBrowse)
+	}
+	wg.Wait()
+
+	for loc, r := range found {
+		if s := fetchSpeakerInfo(loc, r.usn); s != nil {
+			if r.maxAge > 0 {
+				s.Expires = time.Now().Add(r.maxAge)
+			}
+			result[s.ID] = s
+		}
+	}
+	return result
+}
+
+// ssdpDiscover sends an M-SEARCH on every discovery interface at once and
+// merges the replies by LOCATION.
+func ssdpDiscover() map[string]discoveredLocation {
+	ifaces := ssdpInterfaces()
+	if len(ifaces) == 0 {
+		log.Println("SSDP: no multicast interface found, searching via the default route")
+		ifaces = []ssdpInterface{{}}
+	}
+
+	responses := make(map[string]discoveredLocation)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, ifc := range ifaces {
+		wg.Add(1)
+		go func(ifc ssdpInterface) {
+			defer wg.Done()
+			found := ssdpSearch(ifc)
+			mu.Lock()
+			for loc, r := range found {
+				responses[loc] = r
+			}
+			mu.Unlock()
+		}(ifc)
+	}
+	wg.Wait()
+	return responses
+}
+
+// ssdpSearch sends an M-SEARCH out of one interface and collects the replies
+// by LOCATION. A zero ssdpInterface lets the OS pick the route.
+func ssdpSearch(ifc ssdpInterface) map[string]discoveredLocation {
+	responses := make(map[string]discoveredLocation)
+
 	ssdpAddr := "239.255.255.250:1900"
 	searchTarget := "urn:schemas-upnp-org:device:ZonePlayer:1"
 
@@ -93,44 +355,90 @@ func discoverSonos() map[string]*SonosSpeaker {
 	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
 	if err != nil {
 		log.Printf("SSDP resolve error: %v", err)
-		return result
+		return responses
 	}
 
-	conn, err := net.ListenUDP("udp4", nil)
+	var laddr *net.UDPAddr
+	if ifc.IP != nil {
+		laddr = &net.UDPAddr{IP: ifc.IP}
+	}
+	conn, err := net.ListenUDP("udp4", laddr)
 	if err != nil {
-		log.Printf("SSDP listen error: %v", err)
-		return result
+		log.Printf("SSDP listen error on %s: %v", ifc, err)
+		return responses
 	}
 	defer conn.Close()
 
+	if ifc.IP != nil {
+		if err := setMulticastInterface(conn, ifc.IP); err != nil {
+			log.Printf("SSDP: cannot select interface %s: %v", ifc, err)
+		}
+	}
+
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 	conn.WriteToUDP([]byte(msg), addr)
 
-	locations := make(map[string]bool)
 	buf := make([]byte, 4096)
 	for {
 		n, _, err := conn.ReadFromUDP(buf)
 		if err != nil {
 			break
 		}
-		for _, line := range strings.Split(string(buf[:n]), "\r\n") {
-			upper := strings.ToUpper(line)
-			if strings.HasPrefix(upper, "LOCATION:") {
-				loc := strings.TrimSpace(line[len("LOCATION:"):])
-				locations[loc] = true
+		_, headers := parseSSDPMessage(string(buf[:n]))
+		if loc := headers["LOCATION"]; loc != "" {
+			responses[loc] = discoveredLocation{
+				usn:    headers["USN"],
+				maxAge: parseMaxAge(headers["CACHE-CONTROL"]),
 			}
 		}
 	}
+	return responses
+}
 
-	for loc := range locations {
-		if s := fetchSpeakerInfo(loc); s != nil {
-			result[s.ID] = s
+// discoveredLocation is what a discovery backend knows about a device
+// description URL before fetching it.
+type discoveredLocation struct {
+	usn    string
+	maxAge time.Duration
+}
+
+// parseSSDPMessage splits an SSDP datagram into its start line and headers.
+// Header names are upper-cased; values are trimmed.
+func parseSSDPMessage(msg string) (string, map[string]string) {
+	lines := strings.Split(msg, "\r\n")
+	headers := make(map[string]string)
+	for _, line := range lines[1:] {
+		idx := strings.Index(line, ":")
+		if idx <= 0 {
+			continue
 		}
+		key := strings.ToUpper(strings.TrimSpace(line[:idx]))
+		headers[key] = strings.TrimSpace(line[idx+1:])
 	}
-	return result
+	return strings.TrimSpace(lines[0]), headers
+}
+
+// parseMaxAge extracts max-age from a CACHE-CONTROL header value. It returns
+// zero when the header is missing or malformed.
+func parseMaxAge(cacheControl string) time.Duration {
+	for _, part := range strings.Split(cacheControl, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "max-age") {
+			continue
+		}
+		secs, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	return 0
 }
 
-func fetchSpeakerInfo(location string) *SonosSpeaker {
+// fetchSpeakerInfo reads a player's device description. The speaker is keyed
+// by the UDN in the description, falling back to the uuid in the SSDP USN
+// (pass "" when there is none) and finally to the room-name alias.
+func fetchSpeakerInfo(location, usn string) *SonosSpeaker {
 	client := http.Client{Timeout: 3 * time.Second}
 	resp, err := client.Get(location)
 	if err != nil {
@@ -156,154 +464,213 @@ func fetchSpeakerInfo(location string) *SonosSpeaker {
 		return nil
 	}
 
-	id := strings.ToLower(strings.ReplaceAll(roomName, " ", ""))
+	alias := speakerAlias(roomName)
+	id := uuidFromUSN(desc.Device.UDN)
+	if id == "" {
+		id = uuidFromUSN(usn)
+	}
+	if id == "" {
+		id = alias
+	}
+
+	return &SonosSpeaker{
+		Name:            roomName,
+		ID:              id,
+		Alias:           alias,
+		Location:        baseURLOf(location),
+		DescriptionURL:  location,
+		Source:          sourceDiscovery,
+		Model:           desc.Device.ModelName,
+		ModelNumber:     desc.Device.ModelNumber,
+		SerialNum:       desc.Device.SerialNum,
+		SoftwareVersion: desc.Device.SoftwareVersion,
+		HardwareVersion: desc.Device.HardwareVersion,
+		Services:        collectServices(desc.Device),
+	}
+}
+
+// speakerAlias normalizes a room name into the short form users type,
+// e.g. "Living Room" -> "livingroom".
+func speakerAlias(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, " ", ""))
+}
+
+// uuidFromUSN extracts the device UUID from a UDN or SSDP USN, e.g.
+// "uuid:RINCON_000E58A1B2C301400::urn:schemas-upnp-org:device:ZonePlayer:1"
+// -> "RINCON_000E58A1B2C301400".
+func uuidFromUSN(usn string) string {
+	uuid, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(usn), "uuid:"), "::")
+	return uuid
+}
+
+// resolveSpeakerLocked finds a speaker by ID or by room-name alias. When a
+// stereo pair shares a room name, the visible half wins. The caller must
+// hold speakersMu for reading.
+func resolveSpeakerLocked(target string) (*SonosSpeaker, error) {
+	if s, ok := speakers[target]; ok {
+		return s, nil
+	}
+
+	alias := speakerAlias(target)
+	var matches []*SonosSpeaker
+	for _, s := range speakers {
+		if s.Alias == alias || strings.EqualFold(s.ID, target) {
+			matches = append(matches, s)
+		}
+	}
+	if len(matches) > 1 {
+		var visible []*SonosSpeaker
+		for _, s := range matches {
+			if role, _ := speakerRoleLocked(s); role != roleBonded {
+				visible = append(visible, s)
+			}
+		}
+		if len(visible) > 0 {
+			matches = visible
+		}
+	}
 
-	// Extract base URL: http://host:port
-	baseURL := location
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%w: %q", errSpeakerNotFound, target)
+	case 1:
+		return matches[0], nil
+	default:
+		ids := make([]string, len(matches))
+		for i, s := range matches {
+			ids[i] = s.ID
+		}
+		return nil, fmt.Errorf("speaker %q is ambiguous, use one of the ids: %s", target, strings.Join(ids, ", "))
+	}
+}
+
+// baseURLOf reduces a description URL to its scheme and host, e.g.
+// http://192.168.1.10:1400/xml/device_description.xml -> http://192.168.1.10:1400
+func baseURLOf(location string) string {
 	// Skip past "http://" (7 chars) or "https://" (8 chars) then find next "/"
 	schemeEnd := strings.Index(location, "://")
 	if schemeEnd >= 0 {
 		rest := location[schemeEnd+3:]
 		if slashIdx := strings.Index(rest, "/"); slashIdx >= 0 {
-			baseURL = location[:schemeEnd+3+slashIdx]
+			return location[:schemeEnd+3+slashIdx]
 		}
 	}
-
-	return &SonosSpeaker{
-		Name:     roomName,
-		ID:       id,
-		Location: baseURL,
-	}
+	return location
 }
 
 func logSpeakers() {
+	speakersMu.RLock()
+	defer speakersMu.RUnlock()
+
 	fmt.Println("Discovered Sonos Speakers:")
 	if len(speakers) == 0 {
 		fmt.Println("  (none found)")
 		return
 	}
 	for _, s := range speakers {
-		fmt.Printf("- %s (id: %s)\n", s.Name, s.ID)
+		fmt.Printf("- %s (alias: %s, id: %s, source: %s)\n", s.Name, s.Alias, s.ID, s.Source)
 	}
 }
 
-// --------------- Text-to-Speech ---------------
-
-func generateTTS(text string) (string, error) {
-	filename := fmt.Sprintf("%d", time.Now().UnixNano())
-	aiffPath := filepath.Join("tts", filename+".aiff")
-	mp3Path := filepath.Join("tts", filename+".mp3")
-
-	// Generate AIFF using macOS say
-	if err := exec.Command("say", "-o", aiffPath, text).Run(); err != nil {
-		return "", fmt.Errorf("say failed: %w", err)
-	}
-
-	// Convert AIFF -> MP3
-	if err := exec.Command("afconvert", "-f", "mp3 ", "-d", ".mp3", aiffPath, mp3Path).Run(); err != nil {
-		// Fallback: try AAC if MP3 encoding is unavailable
-		mp3Path = filepath.Join("tts", filename+".m4a")
-		if err2 := exec.Command("afconvert", "-f", "mp4f", "-d", "aac", aiffPath, mp3Path).Run(); err2 != nil {
-			return "", fmt.Errorf("afconvert failed (mp3: %v, aac: %v)", err, err2)
-		}
-	}
+// --------------- Sonos Playback ---------------
 
-	os.Remove(aiffPath)
-	return mp3Path, nil
+// announceOptions are the per-announcement settings of speak.
+type announceOptions struct {
+	// Volume overrides the configured announcement volume of every target
+	// unless it is noVolume.
+	Volume int
+	// Mode is modeParallel or modeGroup.
+	Mode string
+	// Title is shown in the Sonos app while the clip plays. It defaults to
+	// the announcement text.
+	Title string
+	// Priority is one of the priority constants; the zero value is low.
+	Priority int
+	// Expiry is how long the announcement may wait in the queue; zero means
+	// ANNOUNCE_EXPIRY.
+	Expiry time.Duration
+	// Chime is played ahead of the speech: a chime name, chimeNone, or ""
+	// for the one configured for the priority.
+	Chime string
 }
 
-// --------------- Sonos Playback ---------------
-
-func speak(text, target string) error {
-	mp3Path, err := generateTTS(text)
+// speak queues an announcement of text on target, "all" or a
+// comma-separated list of speakers, and waits until it has played on every
+// speaker. Cancelling ctx withdraws it from the queue or stops it early; the
+// speakers are still restored.
+func speak(ctx context.Context, text, target string, opts announceOptions) (*announcement, error) {
+	a, err := enqueueAnnouncement(ctx, text, target, opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return a, a.wait(ctx)
+}
 
-	mp3URL := fmt.Sprintf("http://%s:8080/%s", localIP, mp3Path)
-
+// resolveAnnouncementTargets picks the speakers an announcement plays on:
+// the target coordinators, and in group mode with several targets every
+// player that joins the announcement group. The speakers are copies, since
+// playback lasts as long as the clip and must not hold speakersMu while
+// discovery and health checks update the entries.
+func resolveAnnouncementTargets(target, mode string) ([]*SonosSpeaker, []*groupParticipant, error) {
 	speakersMu.RLock()
 	defer speakersMu.RUnlock()
 
-	if target == "" || target == "all" {
-		var lastErr error
-		for _, s := range speakers {
-			if err := playSonos(s, mp3URL); err != nil {
-				log.Printf("Error playing on %s: %v", s.Name, err)
-				lastErr = err
-			}
-		}
-		return lastErr
+	targets, err := announceTargetsLocked(target)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	s, ok := speakers[target]
-	if !ok {
-		return fmt.Errorf("speaker %q not found", target)
+	var parts []*groupParticipant
+	if mode == modeGroup && len(targets) > 1 {
+		parts = groupParticipantsLocked(targets)
 	}
-	return playSonos(s, mp3URL)
-}
-
-func playSonos(speaker *SonosSpeaker, mediaURL string) error {
-	controlURL := speaker.Location + "/MediaRenderer/AVTransport/Control"
-
-	// SetAVTransportURI
-	setURIBody := `<?xml version="1.0" encoding="utf-8"?>
-<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"
- s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
-  <s:Body>
-    <u:SetAVTransportURI xmlns:u="urn:schemas-upnp-org:service:AVTransport:1">
-      <InstanceID>0</InstanceID>
-      <CurrentURI>` + xmlEscape(mediaURL) + `</CurrentURI>
-      <CurrentURIMetaData></CurrentURIMetaData>
-    </u:SetAVTransportURI>
-  </s:Body>
-</s:Envelope>`
-
-	if err := soapCall(controlURL, "SetAVTransportURI", setURIBody); err != nil {
-		return fmt.Errorf("SetAVTransportURI: %w", err)
+	for i, s := range targets {
+		c := *s
+		targets[i] = &c
 	}
+	for _, p := range parts {
+		c := *p.speaker
+		p.speaker = &c
+	}
+	return targets, parts, nil
+}
 
-	// Small delay to let Sonos buffer
-	time.Sleep(300 * time.Millisecond)
-
-	// Play
-	playBody := `<?xml version="1.0" encoding="utf-8"?>
-<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"
- s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
-  <s:Body>
-    <u:Play xmlns:u="urn:schemas-upnp-org:service:AVTransport:1">
-      <InstanceID>0</InstanceID>
-      <Speed>1</Speed>
-    </u:Play>
-  </s:Body>
-</s:Envelope>`
-
-	if err := soapCall(controlURL, "Play", playBody); err != nil {
-		return fmt.Errorf("Play: %w", err)
+// playAnnouncement plays a's clip on the resolved speakers and reports how
+// it went on each of them once every clip has finished.
+func playAnnouncement(ctx context.Context, a *announcement, targets []*SonosSpeaker, parts []*groupParticipant) ([]playbackResult, error) {
+	volumeFor := func(s *SonosSpeaker) int {
+		if a.Opts.Volume != noVolume {
+			return a.Opts.Volume
+		}
+		return announceVolumeFor(s)
 	}
+	return playback.play(ctx, targets, parts, playbackRequest{clip: a.Clip, priority: a.Opts.Priority, volume: volumeFor, stops: &a.stops})
+}
 
-	return nil
+// setClipURI loads mediaURL, described by the DIDL-Lite metaData, into the
+// speaker's transport without starting it.
+func setClipURI(ctx context.Context, speaker *SonosSpeaker, mediaURL, metaData string) error {
+	return setAVTransportURI(ctx, speaker, mediaURL, metaData)
 }
 
-func soapCall(url, action, body string) error {
-	req, err := http.NewRequest("POST", url, strings.NewReader(body))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
-	req.Header.Set("SOAPAction", "urn:schemas-upnp-org:service:AVTransport:1#"+action)
+// startPlayback presses Play on the speaker's transport.
+func startPlayback(ctx context.Context, speaker *SonosSpeaker) error {
+	return play(ctx, speaker)
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// getVolume reads the master volume (0-100) through RenderingControl.
+func getVolume(ctx context.Context, speaker *SonosSpeaker) (int, error) {
+	var out volumeInfo
+	err := speaker.invoke(ctx, renderingControlService, "GetVolume", channelArgs{Channel: "Master"}, &out)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer resp.Body.Close()
+	return out.CurrentVolume, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("SOAP %s returned %d: %s", action, resp.StatusCode, string(respBody))
-	}
-	return nil
+// setVolume sets the master volume (0-100) through RenderingControl.
+func setVolume(ctx context.Context, speaker *SonosSpeaker, volume int) error {
+	return speaker.invoke(ctx, renderingControlService, "SetVolume",
+		setVolumeArgs{Channel: "Master", DesiredVolume: volume}, nil)
 }
 
 func xmlEscape(s string) string {
@@ -316,10 +683,15 @@ func xmlEscape(s string) string {
 
 // --------------- File Server (port 8080) ---------------
 
-func startFileServer(ip string) {
-	addr := ip + ":8080"
-	log.Printf("Starting TTS file server on %s", addr)
-	if err := http.ListenAndServe(addr, http.FileServer(http.Dir("."))); err != nil {
+func startFileServer(hosts []string) {
+	lns, err := listenAll(hosts, 8080)
+	if err != nil {
+		log.Fatalf("File server error: %v", err)
+	}
+	for _, ln := range lns {
+		log.Printf("Starting TTS file server on %s", ln.Addr())
+	}
+	if err := serveAll(lns, http.FileServer(http.Dir("."))); err != nil {
 		log.Fatalf("File server error: %v", err)
 	}
 }
@@ -327,36 +699,91 @@ func startFileServer(ip string) {
 // --------------- API Server (port 9000) ---------------
 
 type speakerJSON struct {
-	Name string `json:"name"`
-	ID   string `json:"id"`
+	Name        string `json:"name"`
+	ID          string `json:"id"`
+	Alias       string `json:"alias"`
+	Model       string `json:"model,omitempty"`
+	Source      string `json:"source"`
+	Role        string `json:"role,omitempty"`
+	Coordinator string `json:"coordinator,omitempty"`
+	Online      bool   `json:"online"`
+	LastSeen    string `json:"last_seen,omitempty"`
+	Failures    int    `json:"consecutive_failures"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+type speakerDetailJSON struct {
+	speakerJSON
+	Location        string                 `json:"location"`
+	ModelNumber     string                 `json:"model_number,omitempty"`
+	SerialNum       string                 `json:"serial_num,omitempty"`
+	SoftwareVersion string                 `json:"software_version,omitempty"`
+	HardwareVersion string                 `json:"hardware_version,omitempty"`
+	Services        map[string]upnpService `json:"services"`
+	State           *speakerState          `json:"state,omitempty"` // live state from events
 }
 
 type speakersResponse struct {
 	Speakers []speakerJSON `json:"speakers"`
 }
 
+type speakResponse struct {
+	ID      string           `json:"id"`
+	Status  string           `json:"status"` // "ok"; "partial" when some speakers failed; "interrupted"; "cancelled"
+	Results []playbackResult `json:"results"`
+}
+
+// announceRequest holds the fields /speak and /play share.
+type announceRequest struct {
+	Target    string `json:"target"`
+	Volume    *int   `json:"volume,omitempty"`     // 0-100, overrides the configured announcement volume
+	Mode      string `json:"mode,omitempty"`       // "parallel" or "group", defaults to ANNOUNCE_MODE
+	Title     string `json:"title,omitempty"`      // shown in the Sonos app, defaults to the text or file name
+	Priority  string `json:"priority,omitempty"`   // "low", "normal" (default), "high" or "urgent"
+	ExpiresIn int    `json:"expires_in,omitempty"` // seconds it may wait in the queue, defaults to ANNOUNCE_EXPIRY
+	Async     bool   `json:"async,omitempty"`      // answer 202 right after queueing
+}
+
 type speakRequest struct {
-	Text   string `json:"text"`
-	Target string `json:"target"`
+	Text string `json:"text"`
+	announceRequest
+	Chime string `json:"chime,omitempty"` // chime name or "none", defaults to the configured chime
+}
+
+type playRequest struct {
+	URL  string `json:"url"`  // http(s) URL the speakers fetch the audio from
+	MIME string `json:"mime"` // MIME type of the audio at URL, detected if empty
+	announceRequest
 }
 
-func startAPIServer(ip string) {
+func startAPIServer(hosts []string) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/speakers", handleSpeakers)
+	mux.HandleFunc("/speakers/", handleSpeakerDetail)
 	mux.HandleFunc("/speak", handleSpeak)
+	mux.HandleFunc("/play", handlePlay)
+	mux.HandleFunc("/announcements", handleAnnouncements)
+	mux.HandleFunc("/announcements/", handleAnnouncementDetail)
+	mux.HandleFunc("/chimes", handleChimes)
+	mux.HandleFunc("/chimes/", handleChimeDetail)
 	mux.HandleFunc("/swagger.yaml", handleSwaggerSpec)
 	mux.HandleFunc("/swagger/", handleSwaggerUI)
 
-	addr := ip + ":9000"
-	log.Printf("Starting API server on %s", addr)
-	log.Printf("Swagger UI available at http://%s:9000/swagger/", ip)
-	if err := http.ListenAndServe(addr, mux); err != nil {
+	lns, err := listenAll(hosts, 9000)
+	if err != nil {
+		log.Fatalf("API server error: %v", err)
+	}
+	for _, ln := range lns {
+		log.Printf("Starting API server on %s", ln.Addr())
+	}
+	log.Printf("Swagger UI available at http://%s/swagger/", lns[0].Addr())
+	if err := serveAll(lns, mux); err != nil {
 		log.Fatalf("API server error: %v", err)
 	}
 }
 
 func handleSwaggerSpec(w http.ResponseWriter, r *http.Request) {
-	spec := strings.ReplaceAll(string(swaggerSpec), "http://localhost:9000", "http://"+localIP+":9000")
+	spec := strings.ReplaceAll(string(swaggerSpec), "http://localhost:9000", "http://"+r.Host)
 	w.Header().Set("Content-Type", "application/yaml")
 	w.Write([]byte(spec))
 }
@@ -397,13 +824,82 @@ func handleSpeakers(w http.ResponseWriter, r *http.Request) {
 
 	resp := speakersResponse{Speakers: make([]speakerJSON, 0, len(speakers))}
 	for _, s := range speakers {
-		resp.Speakers = append(resp.Speakers, speakerJSON{Name: s.Name, ID: s.ID})
+		resp.Speakers = append(resp.Speakers, speakerJSONLocked(s))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// handleSpeakerDetail serves GET /speakers/{id}, where id may also be an
+// alias or room name.
+func handleSpeakerDetail(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/speakers/"), "/")
+	switch action {
+	case "":
+	case "stop":
+		handleStopSpeaker(w, r, id)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	speakersMu.RLock()
+	defer speakersMu.RUnlock()
+
+	s, err := resolveSpeakerLocked(id)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errSpeakerNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	resp := speakerDetailJSON{
+		speakerJSON:     speakerJSONLocked(s),
+		Location:        s.Location,
+		ModelNumber:     s.ModelNumber,
+		SerialNum:       s.SerialNum,
+		SoftwareVersion: s.SoftwareVersion,
+		HardwareVersion: s.HardwareVersion,
+		Services:        s.Services,
+		State:           speakerStateFor(s.ID),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// speakerJSONLocked builds the list entry for a speaker. The caller must
+// hold speakersMu for reading.
+func speakerJSONLocked(s *SonosSpeaker) speakerJSON {
+	entry := speakerJSON{
+		Name:      s.Name,
+		ID:        s.ID,
+		Alias:     s.Alias,
+		Model:     s.Model,
+		Source:    s.Source,
+		Online:    s.Online,
+		Failures:  s.Failures,
+		LastError: s.LastError,
+	}
+	if !s.LastSeen.IsZero() {
+		entry.LastSeen = s.LastSeen.Format(time.RFC3339)
+	}
+	if role, coordinator := speakerRoleLocked(s); coordinator != nil {
+		entry.Role = role
+		entry.Coordinator = coordinator.ID
+	}
+	return entry
+}
+
 func handleSpeak(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -421,18 +917,93 @@ func handleSpeak(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	target := req.Target
-	if target == "" {
-		target = "all"
+	opts, err := req.options()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Chime != "" {
+		if opts.Chime, err = parseChime(req.Chime); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	a, err := enqueueAnnouncement(r.Context(), req.Text, req.target(), opts)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNoTTSEngine) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
 	}
+	respondAnnouncement(w, r, a, req.Async)
+}
 
-	if err := speak(req.Text, target); err != nil {
+// options validates the settings shared by /speak and /play.
+func (req *announceRequest) options() (announceOptions, error) {
+	opts := announceOptions{Volume: noVolume}
+	if req.Volume != nil {
+		if !validVolume(*req.Volume) {
+			return opts, errors.New(`"volume" must be between 0 and 100`)
+		}
+		opts.Volume = *req.Volume
+	}
+	mode, err := parseAnnounceMode(req.Mode)
+	if err != nil {
+		return opts, err
+	}
+	opts.Mode = mode
+	opts.Title = strings.TrimSpace(req.Title)
+	if opts.Priority, err = parsePriority(req.Priority); err != nil {
+		return opts, err
+	}
+	if req.ExpiresIn < 0 {
+		return opts, errors.New(`"expires_in" must be a positive number of seconds`)
+	}
+	opts.Expiry = time.Duration(req.ExpiresIn) * time.Second
+	return opts, nil
+}
+
+func (req *announceRequest) target() string {
+	if req.Target == "" {
+		return "all"
+	}
+	return req.Target
+}
+
+// respondAnnouncement answers a queued announcement: right away with 202
+// when async, otherwise once it has finished. A client that disconnects
+// while waiting withdraws or cancels the announcement.
+func respondAnnouncement(w http.ResponseWriter, r *http.Request, a *announcement, async bool) {
+	if async {
+		announcementsMu.Lock()
+		resp := announcementJSONLocked(a)
+		announcementsMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/announcements/"+a.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	err := a.wait(r.Context())
+	resp := speakResponse{ID: a.ID, Status: "ok", Results: a.Results}
+	switch a.Status {
+	case announcementExpired:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	case announcementFailed:
+		// Only fail the request when no speaker played the clip.
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
+	case announcementPartial, announcementInterrupted, announcementCancelled, announcementSkipped:
+		resp.Status = a.Status
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	json.NewEncoder(w).Encode(resp)
 }
 
 // --------------- Telegram Bot ---------------
@@ -479,15 +1050,40 @@ func startTelegramBot() {
 			continue
 		}
 
+		// Announcements wait their turn in the queue, so they must not hold
+		// up the update loop.
+		if rest, ok := telegramCommand(text, "/group", bot.Self.UserName); ok {
+			go handleTelegramAnnouncement(bot, update.Message.Chat.ID, rest, modeGroup, priorityNormal)
+			continue
+		}
+		if rest, ok := telegramCommand(text, "/urgent", bot.Self.UserName); ok {
+			go handleTelegramAnnouncement(bot, update.Message.Chat.ID, rest, defaultAnnounceMode, priorityUrgent)
+			continue
+		}
+		if rest, ok := telegramCommand(text, "/stop", bot.Self.UserName); ok {
+			go handleTelegramStop(bot, update.Message.Chat.ID, rest)
+			continue
+		}
+
 		// Skip other bot commands
 		if strings.HasPrefix(text, "/") {
 			continue
 		}
 
-		handleTelegramAnnouncement(bot, update.Message.Chat.ID, text)
+		go handleTelegramAnnouncement(bot, update.Message.Chat.ID, text, defaultAnnounceMode, priorityNormal)
 	}
 }
 
+// telegramCommand reports whether text invokes command, optionally addressed
+// as command@botname, and returns the text after it.
+func telegramCommand(text, command, botName string) (string, bool) {
+	word, rest, _ := strings.Cut(text, " ")
+	if word != command && word != command+"@"+botName {
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
 func handleTelegramSpeakers(bot *tgbotapi.BotAPI, chatID int64) {
 	speakersMu.RLock()
 	defer speakersMu.RUnlock()
@@ -500,30 +1096,97 @@ func handleTelegramSpeakers(bot *tgbotapi.BotAPI, chatID int64) {
 	var sb strings.Builder
 	sb.WriteString("Available Sonos Speakers:\n\n")
 	for _, s := range speakers {
-		fmt.Fprintf(&sb, "\u2022 %s \u2192 id: %s\n", s.Name, s.ID)
+		fmt.Fprintf(&sb, "\u2022 %s \u2192 %s (id: %s)", s.Name, s.Alias, s.ID)
+		if s.Source == sourceConfig {
+			sb.WriteString(" [config]")
+		}
+		if !s.Online {
+			fmt.Fprintf(&sb, " \u26a0 offline, last seen %s", s.LastSeen.Format("15:04"))
+		}
+		switch role, coordinator := speakerRoleLocked(s); role {
+		case roleMember:
+			fmt.Fprintf(&sb, " (grouped with %s)", coordinator.Name)
+		case roleBonded:
+			fmt.Fprintf(&sb, " (bonded, plays with %s)", coordinator.Name)
+		}
+		sb.WriteString("\n")
 	}
-	sb.WriteString("\nSend:\nkitchen: Dinner is ready\nOR just:\nDinner is ready")
+	sb.WriteString("\nSend:\nkitchen: Dinner is ready\nOR just:\nDinner is ready\n" +
+		"Several rooms: kitchen, office: Dinner is ready\n" +
+		"In sync as one group: /group kitchen, office: Dinner is ready\n" +
+		"Ahead of everything else: /urgent Front door open\n" +
+		"Stop all announcements: /stop\n" +
+		"Stop a speaker: /stop kitchen")
 
 	bot.Send(tgbotapi.NewMessage(chatID, sb.String()))
 }
 
-func handleTelegramAnnouncement(bot *tgbotapi.BotAPI, chatID int64, text string) {
+// handleTelegramStop cancels every announcement, or with a list of speakers
+// stops just those.
+func handleTelegramStop(bot *tgbotapi.BotAPI, chatID int64, names string) {
+	if names == "" {
+		reply := "Nothing to stop."
+		if n := cancelAllAnnouncements(); n == 1 {
+			reply = "Stopped 1 announcement."
+		} else if n > 1 {
+			reply = fmt.Sprintf("Stopped %d announcements.", n)
+		}
+		bot.Send(tgbotapi.NewMessage(chatID, reply))
+		return
+	}
+
+	var lines []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		speaker, coordinator, err := resolveStopTarget(name)
+		var res *stopResult
+		if err == nil {
+			res, err = stopSpeaker(context.Background(), speaker, coordinator)
+		}
+		switch {
+		case err != nil:
+			lines = append(lines, name+": Error: "+err.Error())
+		case res.Stopped == "announcement":
+			lines = append(lines, res.Name+": announcement stopped, playback restored")
+		default:
+			lines = append(lines, res.Name+": stopped")
+		}
+	}
+	bot.Send(tgbotapi.NewMessage(chatID, strings.Join(lines, "\n")))
+}
+
+func handleTelegramAnnouncement(bot *tgbotapi.BotAPI, chatID int64, text, mode string, priority int) {
 	target := "all"
+	targetName := "all"
 	message := text
 
-	// If message contains ":" the left side is the target speaker
+	// If message contains ":" the left side is the target speaker, or a
+	// comma-separated list of them, given as room names, aliases or IDs
 	if idx := strings.Index(text, ":"); idx > 0 {
-		candidate := strings.TrimSpace(text[:idx])
-		// Normalize candidate the same way speaker IDs are normalized
-		candidateID := strings.ToLower(strings.ReplaceAll(candidate, " ", ""))
-
+		var ids, names []string
+		var err error
 		speakersMu.RLock()
-		_, exists := speakers[candidateID]
+		for _, candidate := range strings.Split(text[:idx], ",") {
+			var s *SonosSpeaker
+			if s, err = resolveSpeakerLocked(strings.TrimSpace(candidate)); err != nil {
+				break
+			}
+			ids = append(ids, s.ID)
+			names = append(names, s.Name)
+		}
 		speakersMu.RUnlock()
 
-		if exists {
-			target = candidateID
+		switch {
+		case err == nil:
+			target = strings.Join(ids, ",")
+			targetName = strings.Join(names, ", ")
 			message = strings.TrimSpace(text[idx+1:])
+		case !errors.Is(err, errSpeakerNotFound):
+			bot.Send(tgbotapi.NewMessage(chatID, "Error: "+err.Error()))
+			return
 		}
 	}
 
@@ -532,13 +1195,32 @@ func handleTelegramAnnouncement(bot *tgbotapi.BotAPI, chatID int64, text string)
 		return
 	}
 
-	log.Printf("Announcement: %q -> %s", message, target)
+	log.Printf("Announcement: %q -> %s (%s)", message, target, mode)
 
-	if err := speak(message, target); err != nil {
+	a, err := speak(context.Background(), message, target,
+		announceOptions{Volume: noVolume, Mode: mode, Priority: priority})
+	if a == nil || a.Status == announcementFailed || a.Status == announcementExpired {
 		bot.Send(tgbotapi.NewMessage(chatID, "Error: "+err.Error()))
 		return
 	}
 
-	reply := fmt.Sprintf("Announced on %s: %s", target, message)
+	reply := fmt.Sprintf("Announced on %s: %s", targetName, message)
+	switch a.Status {
+	case announcementInterrupted:
+		reply = fmt.Sprintf("Interrupted by an urgent announcement on %s: %s", targetName, message)
+	case announcementCancelled:
+		reply = fmt.Sprintf("Cancelled on %s: %s", targetName, message)
+	case announcementSkipped:
+		reply = fmt.Sprintf("Not announced on %s: %s", targetName, message)
+	}
+	if longest := longestDuration(a.Results); longest > 0 {
+		reply += fmt.Sprintf(" (%.1fs)", longest)
+	}
+	if a.Status == announcementPartial {
+		reply += "\nSome speakers failed: " + err.Error()
+	}
+	if skipped := skippedSpeakers(a.Results); len(skipped) > 0 {
+		reply += "\nSkipped: " + strings.Join(skipped, ", ")
+	}
 	bot.Send(tgbotapi.NewMessage(chatID, reply))
 }
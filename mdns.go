@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------- mDNS / DNS-SD Discovery ---------------
+
+const (
+	mdnsService = "_sonos._tcp.local."
+	mdnsTimeout = 3 * time.Second
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+)
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+// dnsRecord is one resource record from an mDNS answer.
+type dnsRecord struct {
+	Name   string
+	Type   uint16
+	Target string            // PTR and SRV
+	Port   uint16            // SRV
+	IP     net.IP            // A
+	TXT    map[string]string // TXT key=value pairs
+}
+
+// mdnsBrowse queries _sonos._tcp.local on every discovery interface and
+// resolves each instance to a device description URL.
+func mdnsBrowse() map[string]discoveredLocation {
+	ifaces := ssdpInterfaces()
+	if len(ifaces) == 0 {
+		ifaces = []ssdpInterface{{}}
+	}
+
+	var records []dnsRecord
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, ifc := range ifaces {
+		wg.Add(1)
+		go func(ifc ssdpInterface) {
+			defer wg.Done()
+			recs := mdnsQuery(ifc)
+			mu.Lock()
+			records = append(records, recs...)
+			mu.Unlock()
+		}(ifc)
+	}
+	wg.Wait()
+
+	return resolveSonosInstances(records)
+}
+
+// mdnsQuery sends one PTR question from an ephemeral port, which makes
+// responders answer by unicast (RFC 6762 legacy unicast), and collects every
+// record in the replies.
+func mdnsQuery(ifc ssdpInterface) []dnsRecord {
+	group := &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+	var laddr *net.UDPAddr
+	if ifc.IP != nil {
+		laddr = &net.UDPAddr{IP: ifc.IP}
+	}
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		log.Printf("mDNS listen error on %s: %v", ifc, err)
+		return nil
+	}
+	defer conn.Close()
+
+	if ifc.IP != nil {
+		if err := setMulticastInterface(conn, ifc.IP); err != nil {
+			log.Printf("mDNS: cannot select interface %s: %v", ifc, err)
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(mdnsTimeout))
+	if _, err := conn.WriteToUDP(buildDNSQuery(mdnsService, dnsTypePTR), group); err != nil {
+		log.Printf("mDNS query on %s failed: %v", ifc, err)
+		return nil
+	}
+
+	var records []dnsRecord
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		recs, err := parseDNSMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		// Fill in a missing A record from the packet source.
+		for i := range recs {
+			if recs[i].Type == dnsTypeSRV {
+				recs = append(recs, dnsRecord{Name: recs[i].Target, Type: dnsTypeA, IP: src.IP})
+				break
+			}
+		}
+		records = append(records, recs...)
+	}
+	return records
+}
+
+// resolveSonosInstances follows PTR -> SRV/TXT -> A for every _sonos._tcp
+// instance. The TXT "location" key carries the description URL; without it
+// the standard :1400 URL on the resolved host is used.
+func resolveSonosInstances(records []dnsRecord) map[string]discoveredLocation {
+	srv := make(map[string]dnsRecord)
+	txt := make(map[string]map[string]string)
+	addrs := make(map[string]net.IP)
+	var instances []string
+	for _, r := range records {
+		name := strings.ToLower(r.Name)
+		switch r.Type {
+		case dnsTypePTR:
+			if name == mdnsService {
+				instances = append(instances, strings.ToLower(r.Target))
+			}
+		case dnsTypeSRV:
+			srv[name] = r
+		case dnsTypeTXT:
+			txt[name] = r.TXT
+		case dnsTypeA:
+			// Prefer a real A record over the packet-source fallback.
+			if _, ok := addrs[name]; !ok {
+				addrs[name] = r.IP
+			}
+		}
+	}
+
+	result := make(map[string]discoveredLocation)
+	for _, inst := range instances {
+		loc := txt[inst]["location"]
+		if loc == "" {
+			s, ok := srv[inst]
+			if !ok {
+				continue
+			}
+			ip := addrs[strings.ToLower(s.Target)]
+			if ip == nil {
+				continue
+			}
+			loc = "http://" + ip.String() + ":1400/xml/device_description.xml"
+		}
+		// "info=/api/v1/players/RINCON_.../info" names the player.
+		var usn string
+		if info := txt[inst]["info"]; strings.Contains(info, "RINCON_") {
+			usn = "uuid:" + strings.Split(info[strings.Index(info, "RINCON_"):], "/")[0]
+		}
+		result[loc] = discoveredLocation{usn: usn}
+	}
+	return result
+}
+
+// buildDNSQuery encodes a single-question DNS query.
+func buildDNSQuery(name string, qtype uint16) []byte {
+	msg := make([]byte, 12) // ID 0, flags 0, one question
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	msg = appendDNSName(msg, name)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	return msg
+}
+
+func appendDNSName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+// parseDNSMessage returns every answer, authority and additional record of
+// the types mDNS discovery needs.
+func parseDNSMessage(msg []byte) ([]dnsRecord, error) {
+	if len(msg) < 12 {
+		return nil, errDNSMessage
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrCount := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4 // type, class
+	}
+
+	var records []dnsRecord
+	for i := 0; i < rrCount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, errDNSMessage
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		rdLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdLen > len(msg) {
+			return nil, errDNSMessage
+		}
+		rdata := msg[off : off+rdLen]
+
+		r := dnsRecord{Name: name, Type: rtype}
+		switch rtype {
+		case dnsTypeA:
+			if rdLen != 4 {
+				return nil, errDNSMessage
+			}
+			r.IP = net.IP(append([]byte(nil), rdata...))
+		case dnsTypePTR:
+			if r.Target, _, err = readDNSName(msg, off); err != nil {
+				return nil, err
+			}
+		case dnsTypeSRV:
+			if rdLen < 7 {
+				return nil, errDNSMessage
+			}
+			r.Port = binary.BigEndian.Uint16(rdata[4:])
+			if r.Target, _, err = readDNSName(msg, off+6); err != nil {
+				return nil, err
+			}
+		case dnsTypeTXT:
+			r.TXT = parseTXT(rdata)
+		default:
+			off += rdLen
+			continue
+		}
+		records = append(records, r)
+		off += rdLen
+	}
+	return records, nil
+}
+
+// readDNSName decodes a possibly compressed name starting at off and returns
+// it with a trailing dot, plus the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; jumps++ {
+		if off >= len(msg) || jumps > 64 {
+			return "", 0, errDNSMessage
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// parseTXT splits TXT rdata into key=value pairs; keys are lower-cased.
+func parseTXT(rdata []byte) map[string]string {
+	kv := make(map[string]string)
+	for len(rdata) > 0 {
+		l := int(rdata[0])
+		if 1+l > len(rdata) {
+			break
+		}
+		k, v, _ := strings.Cut(string(rdata[1:1+l]), "=")
+		kv[strings.ToLower(k)] = v
+		rdata = rdata[1+l:]
+	}
+	return kv
+}
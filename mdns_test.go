@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// dnsPointer is a compressed name pointing at off.
+func dnsPointer(off int) []byte { return []byte{0xC0 | byte(off>>8), byte(off)} }
+
+// appendDNSRecord appends a resource record owned by the encoded name.
+func appendDNSRecord(msg, name []byte, rtype uint16, rdata []byte) []byte {
+	msg = append(msg, name...)
+	msg = binary.BigEndian.AppendUint16(msg, rtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	msg = binary.BigEndian.AppendUint32(msg, 120)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	return append(msg, rdata...)
+}
+
+// testMDNSResponse is a player's answer to a _sonos._tcp query, compressed
+// the way players compress it, and the records it holds.
+func testMDNSResponse() ([]byte, []dnsRecord) {
+	const question = 12 // offset of the question name
+	msg := buildDNSQuery(mdnsService, dnsTypePTR)
+
+	// PTR: _sonos._tcp.local. -> Living Room._sonos._tcp.local.
+	instance := len(msg) + 2 + 10
+	ptr := append([]byte("\x0bLiving Room"), dnsPointer(question)...)
+	msg = appendDNSRecord(msg, dnsPointer(question), dnsTypePTR, ptr)
+
+	// SRV: the instance -> sonos-1.local.:1400
+	host := len(msg) + 2 + 10 + 6
+	srv := binary.BigEndian.AppendUint16(nil, 0)
+	srv = binary.BigEndian.AppendUint16(srv, 0)
+	srv = binary.BigEndian.AppendUint16(srv, 1400)
+	srv = appendDNSName(srv, "sonos-1.local.")
+	msg = appendDNSRecord(msg, dnsPointer(instance), dnsTypeSRV, srv)
+
+	var txt []byte
+	for _, kv := range []string{"Location=http://192.168.1.10:1400/xml/device_description.xml", "vers=3", "bare"} {
+		txt = append(append(txt, byte(len(kv))), kv...)
+	}
+	msg = appendDNSRecord(msg, dnsPointer(instance), dnsTypeTXT, txt)
+	msg = appendDNSRecord(msg, dnsPointer(host), dnsTypeA, []byte{192, 168, 1, 10})
+	// AAAA is not needed and skipped.
+	msg = appendDNSRecord(msg, dnsPointer(host), 28, make([]byte, 16))
+
+	binary.BigEndian.PutUint16(msg[6:], 1)  // answers
+	binary.BigEndian.PutUint16(msg[10:], 4) // additional records
+
+	return msg, []dnsRecord{
+		{Name: "_sonos._tcp.local.", Type: dnsTypePTR, Target: "Living Room._sonos._tcp.local."},
+		{Name: "Living Room._sonos._tcp.local.", Type: dnsTypeSRV, Target: "sonos-1.local.", Port: 1400},
+		{Name: "Living Room._sonos._tcp.local.", Type: dnsTypeTXT, TXT: map[string]string{
+			"location": "http://192.168.1.10:1400/xml/device_description.xml",
+			"vers":     "3",
+			"bare":     "",
+		}},
+		{Name: "sonos-1.local.", Type: dnsTypeA, IP: net.IP{192, 168, 1, 10}},
+	}
+}
+
+func TestParseDNSMessage(t *testing.T) {
+	msg, want := testMDNSResponse()
+	got, err := parseDNSMessage(msg)
+	if err != nil {
+		t.Fatalf("parseDNSMessage: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDNSMessage =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestReadDNSName(t *testing.T) {
+	// "local." at 0, "x" -> "local." at 7, "y" -> "x.local." at 11.
+	compressed := appendDNSName(nil, "local.")
+	compressed = append(append(compressed, 1, 'x'), dnsPointer(0)...)
+	compressed = append(append(compressed, 1, 'y'), dnsPointer(7)...)
+
+	tests := []struct {
+		name     string
+		msg      []byte
+		off      int
+		want     string // "" when reading must fail
+		wantNext int
+	}{
+		{"plain", appendDNSName(nil, "a.bc."), 0, "a.bc.", 6},
+		{"root", []byte{0}, 0, ".", 1},
+		{"pointer", compressed, 7, "x.local.", 11},
+		{"pointer chain", compressed, 11, "y.x.local.", 15},
+		{"pointer to itself", dnsPointer(0), 0, "", 0},
+		{"pointer loop", append(dnsPointer(2), dnsPointer(0)...), 0, "", 0},
+		{"pointer loop through a label", append([]byte{1, 'a'}, dnsPointer(0)...), 0, "", 0},
+		{"pointer past the end", dnsPointer(16), 0, "", 0},
+		{"pointer cut short", []byte{1, 'a', 0xC0}, 0, "", 0},
+		{"label past the end", []byte{5, 'a', 'b'}, 0, "", 0},
+		{"no terminating zero", []byte{1, 'a'}, 0, "", 0},
+		{"offset past the end", []byte{0}, 5, "", 0},
+		{"empty", nil, 0, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, next, err := readDNSName(tt.msg, tt.off)
+			if tt.want == "" {
+				if !errors.Is(err, errDNSMessage) {
+					t.Errorf("readDNSName = %q, %d, %v, want errDNSMessage", got, next, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readDNSName: %v", err)
+			}
+			if got != tt.want || next != tt.wantNext {
+				t.Errorf("readDNSName = %q, %d, want %q, %d", got, next, tt.want, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestParseDNSMessageMalformed(t *testing.T) {
+	valid, _ := testMDNSResponse()
+	query := buildDNSQuery(mdnsService, dnsTypePTR)
+	// answer builds a response with a single answer record owned by the
+	// question name.
+	answer := func(rtype uint16, rdata []byte) []byte {
+		msg := appendDNSRecord(append([]byte(nil), query...), dnsPointer(12), rtype, rdata)
+		binary.BigEndian.PutUint16(msg[6:], 1)
+		return msg
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"short header", valid[:11]},
+		{"more questions than sent", func() []byte {
+			msg := append([]byte(nil), query...)
+			binary.BigEndian.PutUint16(msg[4:], 2)
+			return msg
+		}()},
+		{"more records than sent", func() []byte {
+			msg := append([]byte(nil), valid...)
+			binary.BigEndian.PutUint16(msg[10:], 5)
+			return msg
+		}()},
+		{"record header cut off", answer(dnsTypeA, []byte{1, 2, 3, 4})[:len(query)+2+5]},
+		{"rdata longer than the message", func() []byte {
+			msg := answer(dnsTypeA, []byte{1, 2, 3, 4})
+			binary.BigEndian.PutUint16(msg[len(msg)-6:], 200)
+			return msg
+		}()},
+		{"short A record", answer(dnsTypeA, []byte{1, 2, 3})},
+		{"short SRV record", answer(dnsTypeSRV, []byte{0, 0, 0, 0, 5, 0x78})},
+		{"PTR pointing past the end", answer(dnsTypePTR, dnsPointer(0x3FFF))},
+		{"PTR pointer loop", func() []byte {
+			// The rdata points at itself.
+			return answer(dnsTypePTR, dnsPointer(len(query)+2+10))
+		}()},
+		{"owner name pointer loop", func() []byte {
+			msg := appendDNSRecord(append([]byte(nil), query...), dnsPointer(len(query)), dnsTypeA, []byte{1, 2, 3, 4})
+			binary.BigEndian.PutUint16(msg[6:], 1)
+			return msg
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDNSMessage(tt.msg)
+			if !errors.Is(err, errDNSMessage) {
+				t.Errorf("parseDNSMessage = %+v, %v, want errDNSMessage", got, err)
+			}
+		})
+	}
+}
+
+// TestParseDNSMessageCorrupt cuts a valid response short at every length and
+// overwrites each of its bytes with values that often mean trouble: parsing
+// may fail but must not panic.
+func TestParseDNSMessageCorrupt(t *testing.T) {
+	valid, _ := testMDNSResponse()
+	for n := 0; n < len(valid); n++ {
+		parseDNSMessage(valid[:n])
+	}
+	for i := range valid {
+		for _, b := range []byte{0x00, 0x3F, 0x40, 0xC0, 0xFF} {
+			msg := append([]byte(nil), valid...)
+			msg[i] = b
+			parseDNSMessage(msg)
+		}
+	}
+}
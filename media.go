@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------- Media Playback ---------------
+
+const (
+	// mediaDir holds files uploaded to /play. The file server shares it
+	// with the speakers like the TTS clips.
+	mediaDir     = "media"
+	maxMediaSize = 50 << 20
+
+	// mediaHeadTimeout bounds the HEAD request that asks a media server
+	// what type of audio a URL serves.
+	mediaHeadTimeout = 5 * time.Second
+)
+
+// handlePlay queues an audio file or URL like an announcement. It takes a
+// JSON playRequest, or a multipart form with the same fields as form values
+// and the audio as "file" instead of "url".
+func handlePlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		req   playRequest
+		media string
+		c     clip
+		err   error
+	)
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "multipart/form-data" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxMediaSize+1<<20)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		if req, err = playRequestFromForm(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := req.options()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case req.URL != "" && r.MultipartForm != nil && r.MultipartForm.File["file"] != nil:
+		http.Error(w, `send either "file" or "url", not both`, http.StatusBadRequest)
+		return
+	case req.URL != "":
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, `"url" must be an http or https URL`, http.StatusBadRequest)
+			return
+		}
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			name = u.Host
+		}
+		mimeType := req.MIME
+		if mimeType != "" {
+			if mimeType, _, err = mime.ParseMediaType(mimeType); err != nil {
+				http.Error(w, `"mime" must be a MIME type such as audio/mpeg`, http.StatusBadRequest)
+				return
+			}
+		} else {
+			mimeType = urlMIMEType(r.Context(), u)
+		}
+		media = req.URL
+		c = newURLClip(req.URL, mediaTitle(opts.Title, name), mimeType)
+	case r.MultipartForm != nil && r.MultipartForm.File["file"] != nil:
+		var status int
+		if media, c, status, err = storeUpload(r, opts.Title); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	default:
+		http.Error(w, `"file" or "url" is required`, http.StatusBadRequest)
+		return
+	}
+
+	a, err := enqueueMedia(media, req.target(), opts, c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondAnnouncement(w, r, a, req.Async)
+}
+
+// urlMIMEType finds the MIME type the speakers are told for media at u: the
+// one its extension implies, or else the Content-Type its server answers a
+// HEAD request with. Players refuse application/octet-stream with UPnP
+// error 714, so that is only the last resort.
+func urlMIMEType(ctx context.Context, u *url.URL) string {
+	if t := audioMIMEType(u.Path); t != "application/octet-stream" {
+		return t
+	}
+	ctx, cancel := context.WithTimeout(ctx, mediaHeadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("HEAD %s failed, its MIME type is unknown: %v", u.Redacted(), err)
+		return "application/octet-stream"
+	}
+	resp.Body.Close()
+	t, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("HEAD %s answered %s without a usable Content-Type; its MIME type is unknown", u.Redacted(), resp.Status)
+		return "application/octet-stream"
+	}
+	return t
+}
+
+// playRequestFromForm reads a playRequest from multipart form values.
+func playRequestFromForm(r *http.Request) (playRequest, error) {
+	req := playRequest{URL: strings.TrimSpace(r.FormValue("url")), MIME: strings.TrimSpace(r.FormValue("mime"))}
+	req.Target = r.FormValue("target")
+	req.Mode = r.FormValue("mode")
+	req.Title = r.FormValue("title")
+	req.Priority = r.FormValue("priority")
+	if v := r.FormValue("volume"); v != "" {
+		vol, err := strconv.Atoi(v)
+		if err != nil {
+			return req, errors.New(`"volume" must be between 0 and 100`)
+		}
+		req.Volume = &vol
+	}
+	if v := r.FormValue("expires_in"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil {
+			return req, errors.New(`"expires_in" must be a positive number of seconds`)
+		}
+		req.ExpiresIn = secs
+	}
+	if v := r.FormValue("async"); v != "" {
+		async, err := strconv.ParseBool(v)
+		if err != nil {
+			return req, errors.New(`"async" must be true or false`)
+		}
+		req.Async = async
+	}
+	return req, nil
+}
+
+// storeUpload saves the "file" part under mediaDir and describes it. The
+// extension decides the MIME type the speakers are told, so files the
+// speakers cannot identify are refused. It returns the status to answer
+// with on error.
+func storeUpload(r *http.Request, title string) (string, clip, int, error) {
+	f, header, err := r.FormFile("file")
+	if err != nil {
+		return "", clip{}, http.StatusBadRequest, err
+	}
+	defer f.Close()
+
+	name := filepath.Base(header.Filename)
+	ext := strings.ToLower(filepath.Ext(name))
+	if audioMIMEType(name) == "application/octet-stream" {
+		return "", clip{}, http.StatusBadRequest,
+			fmt.Errorf("unsupported audio file %q: use MP3, M4A, AAC, WAV, AIFF, FLAC or OGG", name)
+	}
+
+	stored := filepath.Join(mediaDir, fmt.Sprintf("%d%s", time.Now().UnixNano(), ext))
+	out, err := os.Create(stored)
+	if err != nil {
+		return "", clip{}, http.StatusInternalServerError, err
+	}
+	_, err = io.Copy(out, f)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(stored)
+		return "", clip{}, http.StatusInternalServerError, err
+	}
+	log.Printf("Stored upload %q as %s (%d bytes)", name, stored, header.Size)
+	return name, newClip(stored, mediaTitle(title, name)), 0, nil
+}
+
+// mediaTitle is the requested title, or the file name without extension.
+func mediaTitle(title, fileName string) string {
+	if title != "" {
+		return title
+	}
+	if unescaped, err := url.PathUnescape(fileName); err == nil {
+		fileName = unescaped
+	}
+	return clipTitle(strings.TrimSuffix(fileName, filepath.Ext(fileName)))
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// setMulticastInterface is a no-op where IP_MULTICAST_IF is not available;
+// binding the socket to the interface address is the best we can do.
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	return nil
+}
+
+// joinMulticastGroup is a no-op where IP_ADD_MEMBERSHIP is not available;
+// the listener then only hears the interface it was opened on.
+func joinMulticastGroup(conn *net.UDPConn, group, ip net.IP) error {
+	return nil
+}
@@ -0,0 +1,49 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastInterface makes multicast sent on conn leave through the
+// interface that owns ip (IP_MULTICAST_IF), instead of the default route.
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var addr [4]byte
+	copy(addr[:], ip.To4())
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// joinMulticastGroup additionally joins group on the interface that owns ip,
+// so one socket hears announcements from every subnet.
+func joinMulticastGroup(conn *net.UDPConn, group, ip net.IP) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	mreq := &syscall.IPMreq{}
+	copy(mreq.Multiaddr[:], group.To4())
+	copy(mreq.Interface[:], ip.To4())
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptIPMreq(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
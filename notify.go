@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------- SSDP NOTIFY Listener ---------------
+
+const zonePlayerURN = "urn:schemas-upnp-org:device:ZonePlayer:1"
+
+// ssdpSweepInterval is how often expired speakers are pruned.
+const ssdpSweepInterval = 30 * time.Second
+
+// notifyReadBackoff is how long the listener waits after a failed read, so
+// a persistent error does not spin.
+const notifyReadBackoff = time.Second
+
+var (
+	// pendingFetches tracks description URLs whose ssdp:alive is already
+	// being handled, so a burst of duplicate announcements fetches once.
+	pendingFetches   = make(map[string]bool)
+	pendingFetchesMu sync.Mutex
+)
+
+// listenSSDPNotify joins the SSDP multicast group on every discovery
+// interface and tracks the ssdp:alive and ssdp:byebye announcements Sonos
+// players send on their own.
+func listenSSDPNotify() {
+	addr := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+	ifaces := ssdpInterfaces()
+	var first *net.Interface
+	if len(ifaces) > 0 {
+		first, _ = net.InterfaceByName(ifaces[0].Name)
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", first, addr)
+	if err != nil {
+		log.Printf("SSDP NOTIFY listener disabled: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	joined := []string{"default"}
+	if len(ifaces) > 0 {
+		joined = []string{ifaces[0].String()}
+		for _, ifc := range ifaces[1:] {
+			if err := joinMulticastGroup(conn, addr.IP, ifc.IP); err != nil {
+				log.Printf("SSDP NOTIFY listener cannot join on %s: %v", ifc, err)
+				continue
+			}
+			joined = append(joined, ifc.String())
+		}
+	}
+
+	conn.SetReadBuffer(65536)
+	log.Printf("SSDP NOTIFY listener joined 239.255.255.250:1900 on %s", strings.Join(joined, ", "))
+
+	buf := make([]byte, 8192)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			log.Println("SSDP NOTIFY listener closed")
+			return
+		}
+		if err != nil {
+			log.Printf("SSDP NOTIFY read error: %v", err)
+			time.Sleep(notifyReadBackoff)
+			continue
+		}
+		handleSSDPNotify(string(buf[:n]))
+	}
+}
+
+func handleSSDPNotify(msg string) {
+	startLine, headers := parseSSDPMessage(msg)
+	if !strings.HasPrefix(strings.ToUpper(startLine), "NOTIFY ") {
+		return
+	}
+	// Players announce their root device, embedded devices and every
+	// service; the ZonePlayer notification is the one that matters.
+	if headers["NT"] != zonePlayerURN {
+		return
+	}
+
+	switch headers["NTS"] {
+	case "ssdp:alive":
+		handleSSDPAlive(headers)
+	case "ssdp:byebye":
+		handleSSDPByeBye(headers["USN"])
+	}
+}
+
+func handleSSDPAlive(headers map[string]string) {
+	location := headers["LOCATION"]
+	if location == "" {
+		return
+	}
+
+	now := time.Now()
+	var expires time.Time
+	if maxAge := parseMaxAge(headers["CACHE-CONTROL"]); maxAge > 0 {
+		expires = now.Add(maxAge)
+	}
+
+	// Known speaker at the same address: just extend its lease.
+	base := baseURLOf(location)
+	speakersMu.Lock()
+	for _, s := range speakers {
+		if s.Location == base {
+			recordHealthLocked(s, nil, now)
+			if s.Source != sourceConfig {
+				s.Expires = expires
+			}
+			s.missedScans = 0
+			speakersMu.Unlock()
+			return
+		}
+	}
+	speakersMu.Unlock()
+
+	pendingFetchesMu.Lock()
+	if pendingFetches[location] {
+		pendingFetchesMu.Unlock()
+		return
+	}
+	pendingFetches[location] = true
+	pendingFetchesMu.Unlock()
+
+	// New or moved speaker: fetch its description without holding speakersMu.
+	go func() {
+		defer func() {
+			pendingFetchesMu.Lock()
+			delete(pendingFetches, location)
+			pendingFetchesMu.Unlock()
+		}()
+
+		s := fetchSpeakerInfo(location, headers["USN"])
+		if s == nil {
+			log.Printf("SSDP alive from %s but device description failed", location)
+			return
+		}
+		s.Expires = expires
+
+		speakersMu.Lock()
+		mergeSpeakerLocked(s, time.Now())
+		speakersMu.Unlock()
+	}()
+}
+
+func handleSSDPByeBye(usn string) {
+	if usn == "" {
+		return
+	}
+
+	id := uuidFromUSN(usn)
+
+	speakersMu.Lock()
+	defer speakersMu.Unlock()
+
+	if s, ok := speakers[id]; ok && s.Source != sourceConfig {
+		log.Printf("Speaker left: %s (id: %s) sent ssdp:byebye", s.Name, s.ID)
+		delete(speakers, id)
+	}
+}
+
+// expireSpeakers periodically drops speakers whose advertised max-age has
+// run out without a fresh announcement or search response. Configured
+// speakers are never dropped.
+func expireSpeakers() {
+	ticker := time.NewTicker(ssdpSweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		speakersMu.Lock()
+		for id, s := range speakers {
+			if s.Source != sourceConfig && !s.Expires.IsZero() && now.After(s.Expires) {
+				log.Printf("Speaker expired: %s (id: %s), max-age ran out at %s", s.Name, s.ID, s.Expires.Format(time.RFC3339))
+				delete(speakers, id)
+			}
+		}
+		speakersMu.Unlock()
+	}
+}
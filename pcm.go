@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// --------------- PCM Audio ---------------
+
+// pcmAudio is uncompressed audio held as interleaved 16-bit samples. Chimes
+// are joined onto the speech in this form, before the clip is encoded.
+type pcmAudio struct {
+	SampleRate int
+	Channels   int
+	Samples    []int16
+}
+
+func (p *pcmAudio) frames() int {
+	return len(p.Samples) / p.Channels
+}
+
+func (p *pcmAudio) duration() time.Duration {
+	return time.Duration(float64(p.frames()) / float64(p.SampleRate) * float64(time.Second))
+}
+
+// readPCM loads an uncompressed WAV or AIFF file.
+func readPCM(path string) (*pcmAudio, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodePCM(data)
+}
+
+// pcmFormat names the container of data, "wav" or "aiff", or returns "".
+func pcmFormat(data []byte) string {
+	if len(data) < 12 {
+		return ""
+	}
+	switch {
+	case string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		return "wav"
+	case string(data[:4]) == "FORM" && (string(data[8:12]) == "AIFF" || string(data[8:12]) == "AIFC"):
+		return "aiff"
+	}
+	return ""
+}
+
+func decodePCM(data []byte) (*pcmAudio, error) {
+	switch pcmFormat(data) {
+	case "wav":
+		return decodeWAV(data)
+	case "aiff":
+		return decodeAIFF(data)
+	}
+	return nil, fmt.Errorf("%w: expected WAV or AIFF", errUnknownAudio)
+}
+
+// riffChunks calls fn for each chunk of a RIFF or IFF body. Chunks are
+// padded to an even size; a size running past the end is cut short.
+func riffChunks(data []byte, order binary.ByteOrder, fn func(id string, body []byte)) {
+	for len(data) >= 8 {
+		id := string(data[:4])
+		size := uint64(order.Uint32(data[4:]))
+		data = data[8:]
+		if size > uint64(len(data)) {
+			size = uint64(len(data))
+		}
+		fn(id, data[:size])
+		next := size + size&1
+		if next > uint64(len(data)) {
+			return
+		}
+		data = data[next:]
+	}
+}
+
+// WAV format tags.
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+func decodeWAV(data []byte) (*pcmAudio, error) {
+	var (
+		format, channels, bits int
+		rate                   int
+		samples                []byte
+		haveFmt                bool
+	)
+	riffChunks(data[12:], binary.LittleEndian, func(id string, body []byte) {
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:]))
+			channels = int(binary.LittleEndian.Uint16(body[2:]))
+			rate = int(binary.LittleEndian.Uint32(body[4:]))
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+			if format == wavFormatExtensible && len(body) >= 26 {
+				// The real tag opens the sub-format GUID.
+				format = int(binary.LittleEndian.Uint16(body[24:]))
+			}
+			haveFmt = true
+		case "data":
+			samples = body
+		}
+	})
+	if !haveFmt || samples == nil {
+		return nil, fmt.Errorf("%w: missing fmt or data chunk", errUnknownAudio)
+	}
+
+	var enc sampleEncoding
+	switch {
+	case format == wavFormatPCM && bits == 8:
+		enc = sampleEncoding{bits: 8, unsigned: true}
+	case format == wavFormatPCM && (bits == 16 || bits == 24 || bits == 32):
+		enc = sampleEncoding{bits: bits}
+	case format == wavFormatFloat && bits == 32:
+		enc = sampleEncoding{bits: 32, float: true}
+	default:
+		return nil, fmt.Errorf("%w: WAV format %d with %d-bit samples is not supported", errUnknownAudio, format, bits)
+	}
+	return newPCM(rate, channels, samples, enc)
+}
+
+func decodeAIFF(data []byte) (*pcmAudio, error) {
+	compressed := string(data[8:12]) == "AIFC"
+	var (
+		channels, bits int
+		rate           float64
+		samples        []byte
+		compression    = "NONE"
+		haveComm       bool
+	)
+	riffChunks(data[12:], binary.BigEndian, func(id string, body []byte) {
+		switch id {
+		case "COMM":
+			if len(body) < 18 {
+				return
+			}
+			channels = int(binary.BigEndian.Uint16(body[0:]))
+			bits = int(binary.BigEndian.Uint16(body[6:]))
+			rate = float80(body[8:18])
+			if compressed && len(body) >= 22 {
+				compression = string(body[18:22])
+			}
+			haveComm = true
+		case "SSND":
+			if len(body) < 8 {
+				return
+			}
+			offset := binary.BigEndian.Uint32(body[0:])
+			if uint64(offset) > uint64(len(body)-8) {
+				return
+			}
+			samples = body[8+offset:]
+		}
+	})
+	if !haveComm || samples == nil {
+		return nil, fmt.Errorf("%w: missing COMM or SSND chunk", errUnknownAudio)
+	}
+
+	enc := sampleEncoding{bits: bits, bigEndian: true}
+	switch compression {
+	case "NONE", "twos":
+	case "sowt":
+		enc.bigEndian = false
+	case "fl32", "FL32":
+		if bits != 32 {
+			return nil, fmt.Errorf("%w: %d-bit float AIFF samples are not supported", errUnknownAudio, bits)
+		}
+		enc.float = true
+	default:
+		return nil, fmt.Errorf("%w: compressed AIFF (%q) is not supported", errUnknownAudio, compression)
+	}
+	if bits != 8 && bits != 16 && bits != 24 && bits != 32 {
+		return nil, fmt.Errorf("%w: %d-bit AIFF samples are not supported", errUnknownAudio, bits)
+	}
+	if rate < 1 || rate > math.MaxInt32 {
+		return nil, fmt.Errorf("%w: AIFF sample rate %g", errUnknownAudio, rate)
+	}
+	return newPCM(int(math.Round(rate)), channels, samples, enc)
+}
+
+// sampleEncoding describes how samples are stored in a file.
+type sampleEncoding struct {
+	bits      int
+	bigEndian bool
+	unsigned  bool // 8-bit WAV
+	float     bool
+}
+
+func newPCM(rate, channels int, data []byte, enc sampleEncoding) (*pcmAudio, error) {
+	if rate <= 0 || channels <= 0 {
+		return nil, fmt.Errorf("%w: %d Hz, %d channels", errUnknownAudio, rate, channels)
+	}
+	// Every sample is read whole, so only these widths are safe to walk.
+	width := enc.bits / 8
+	if enc.bits%8 != 0 || width < 1 || width > 4 || (enc.float && width != 4) {
+		return nil, fmt.Errorf("%w: %d-bit samples", errUnknownAudio, enc.bits)
+	}
+	frames := len(data) / (width * channels)
+	p := &pcmAudio{SampleRate: rate, Channels: channels, Samples: make([]int16, frames*channels)}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if enc.bigEndian {
+		order = binary.BigEndian
+	}
+	for i := range p.Samples {
+		b := data[i*width:]
+		switch {
+		case enc.float:
+			v := math.Float32frombits(order.Uint32(b))
+			p.Samples[i] = int16(math.Max(-1, math.Min(1, float64(v))) * math.MaxInt16)
+		case width == 1 && enc.unsigned:
+			p.Samples[i] = int16(int(b[0])-128) << 8
+		case width == 1:
+			p.Samples[i] = int16(int8(b[0])) << 8
+		case width == 2:
+			p.Samples[i] = int16(order.Uint16(b))
+		case width == 3 && enc.bigEndian:
+			p.Samples[i] = int16(uint16(b[0])<<8 | uint16(b[1]))
+		case width == 3:
+			p.Samples[i] = int16(uint16(b[2])<<8 | uint16(b[1]))
+		case width == 4:
+			p.Samples[i] = int16(order.Uint32(b) >> 16)
+		}
+	}
+	return p, nil
+}
+
+// float80 decodes the IEEE 754 80-bit extended float AIFF stores its sample
+// rate in.
+func float80(b []byte) float64 {
+	exp := int(binary.BigEndian.Uint16(b) & 0x7FFF)
+	mant := binary.BigEndian.Uint64(b[2:])
+	if exp == 0 && mant == 0 {
+		return 0
+	}
+	return math.Ldexp(float64(mant), exp-16383-63)
+}
+
+func putFloat80(b []byte, v uint32) {
+	if v == 0 {
+		copy(b[:10], make([]byte, 10))
+		return
+	}
+	exp := 16383 + 63
+	mant := uint64(v)
+	for mant&(1<<63) == 0 {
+		mant <<= 1
+		exp--
+	}
+	binary.BigEndian.PutUint16(b, uint16(exp))
+	binary.BigEndian.PutUint64(b[2:], mant)
+}
+
+// encodeAIFF writes p as a 16-bit AIFF file, the format say produces.
+func encodeAIFF(p *pcmAudio) []byte {
+	var buf bytes.Buffer
+	dataSize := len(p.Samples) * 2
+
+	buf.WriteString("FORM")
+	binary.Write(&buf, binary.BigEndian, uint32(4+8+18+8+8+dataSize))
+	buf.WriteString("AIFF")
+
+	comm := make([]byte, 18)
+	binary.BigEndian.PutUint16(comm[0:], uint16(p.Channels))
+	binary.BigEndian.PutUint32(comm[2:], uint32(p.frames()))
+	binary.BigEndian.PutUint16(comm[6:], 16)
+	putFloat80(comm[8:], uint32(p.SampleRate))
+	buf.WriteString("COMM")
+	binary.Write(&buf, binary.BigEndian, uint32(len(comm)))
+	buf.Write(comm)
+
+	buf.WriteString("SSND")
+	binary.Write(&buf, binary.BigEndian, uint32(8+dataSize))
+	binary.Write(&buf, binary.BigEndian, [2]uint32{}) // offset, block size
+	binary.Write(&buf, binary.BigEndian, p.Samples)
+	return buf.Bytes()
+}
+
+// encodeWAV writes p as a 16-bit PCM WAV file.
+func encodeWAV(p *pcmAudio) []byte {
+	var buf bytes.Buffer
+	dataSize := len(p.Samples) * 2
+
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(4+8+16+8+dataSize))
+	buf.WriteString("WAVE")
+
+	buf.WriteString("fmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, struct {
+		Format, Channels uint16
+		SampleRate       uint32
+		ByteRate         uint32
+		BlockAlign, Bits uint16
+	}{
+		wavFormatPCM, uint16(p.Channels),
+		uint32(p.SampleRate), uint32(p.SampleRate * p.Channels * 2),
+		uint16(p.Channels * 2), 16,
+	})
+
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(dataSize))
+	binary.Write(&buf, binary.LittleEndian, p.Samples)
+	return buf.Bytes()
+}
+
+// convert resamples p to rate and remixes it to channels. Resampling is
+// linear, which is plenty for a chime ahead of speech.
+func (p *pcmAudio) convert(rate, channels int) *pcmAudio {
+	if p.SampleRate == rate && p.Channels == channels {
+		return p
+	}
+	srcFrames := p.frames()
+	frames := int(int64(srcFrames) * int64(rate) / int64(p.SampleRate))
+	out := &pcmAudio{SampleRate: rate, Channels: channels, Samples: make([]int16, frames*channels)}
+
+	// sample returns source frame i mixed down to output channel ch.
+	sample := func(i, ch int) float64 {
+		frame := p.Samples[i*p.Channels : (i+1)*p.Channels]
+		if channels == 1 && p.Channels > 1 {
+			var sum float64
+			for _, v := range frame {
+				sum += float64(v)
+			}
+			return sum / float64(p.Channels)
+		}
+		return float64(frame[ch%p.Channels])
+	}
+	for i := 0; i < frames; i++ {
+		pos := float64(i) * float64(p.SampleRate) / float64(rate)
+		j := int(pos)
+		frac := pos - float64(j)
+		for ch := 0; ch < channels; ch++ {
+			v := sample(j, ch)
+			if j+1 < srcFrames {
+				v += (sample(j+1, ch) - v) * frac
+			}
+			out.Samples[i*channels+ch] = int16(v)
+		}
+	}
+	return out
+}
+
+// joinPCM plays a, then gap of silence, then b, in b's format.
+func joinPCM(a *pcmAudio, gap time.Duration, b *pcmAudio) *pcmAudio {
+	a = a.convert(b.SampleRate, b.Channels)
+	silence := int(gap.Seconds()*float64(b.SampleRate)) * b.Channels
+	samples := make([]int16, 0, len(a.Samples)+silence+len(b.Samples))
+	samples = append(samples, a.Samples...)
+	samples = append(samples, make([]int16, silence)...)
+	samples = append(samples, b.Samples...)
+	return &pcmAudio{SampleRate: b.SampleRate, Channels: b.Channels, Samples: samples}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// testTone is a short stereo clip with samples at both ends of the range.
+func testTone() *pcmAudio {
+	return &pcmAudio{
+		SampleRate: 22050,
+		Channels:   2,
+		Samples:    []int16{0, 1, -1, math.MaxInt16, math.MinInt16, 1234, -4321, 0},
+	}
+}
+
+func TestPCMRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		encode func(*pcmAudio) []byte
+		format string
+	}{
+		{"wav", encodeWAV, "wav"},
+		{"aiff", encodeAIFF, "aiff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := testTone()
+			data := tt.encode(want)
+			if got := pcmFormat(data); got != tt.format {
+				t.Fatalf("pcmFormat = %q, want %q", got, tt.format)
+			}
+			got, err := decodePCM(data)
+			if err != nil {
+				t.Fatalf("decodePCM: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decodePCM = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// riffChunk builds one chunk of a RIFF or IFF file, padded to an even size.
+func riffChunk(order binary.ByteOrder, id string, body []byte) []byte {
+	b := make([]byte, 8, 8+len(body)+1)
+	copy(b, id)
+	order.PutUint32(b[4:], uint32(len(body)))
+	b = append(b, body...)
+	if len(body)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// wavFile builds a WAV file from a fmt chunk and raw sample data.
+func wavFile(format, channels, rate, bits int, data []byte) []byte {
+	fmtBody := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtBody[0:], uint16(format))
+	binary.LittleEndian.PutUint16(fmtBody[2:], uint16(channels))
+	binary.LittleEndian.PutUint32(fmtBody[4:], uint32(rate))
+	binary.LittleEndian.PutUint16(fmtBody[14:], uint16(bits))
+	body := append([]byte("WAVE"), riffChunk(binary.LittleEndian, "fmt ", fmtBody)...)
+	body = append(body, riffChunk(binary.LittleEndian, "data", data)...)
+	return append([]byte("RIFF"), append(le32(len(body)), body...)...)
+}
+
+// aiffFile builds an AIFF, or with a compression type an AIFC, file.
+func aiffFile(compression string, channels, bits int, rate uint32, data []byte) []byte {
+	form := "AIFF"
+	comm := make([]byte, 18)
+	binary.BigEndian.PutUint16(comm[0:], uint16(channels))
+	binary.BigEndian.PutUint16(comm[6:], uint16(bits))
+	putFloat80(comm[8:], rate)
+	if compression != "" {
+		form = "AIFC"
+		comm = append(comm, compression...)
+	}
+	ssnd := append(make([]byte, 8), data...)
+	body := append([]byte(form), riffChunk(binary.BigEndian, "COMM", comm)...)
+	body = append(body, riffChunk(binary.BigEndian, "SSND", ssnd)...)
+	return append([]byte("FORM"), append(be32(len(body)), body...)...)
+}
+
+func le32(n int) []byte { return binary.LittleEndian.AppendUint32(nil, uint32(n)) }
+func be32(n int) []byte { return binary.BigEndian.AppendUint32(nil, uint32(n)) }
+
+func TestDecodePCM(t *testing.T) {
+	float := func(order binary.AppendByteOrder, vs ...float32) []byte {
+		var b []byte
+		for _, v := range vs {
+			b = order.AppendUint32(b, math.Float32bits(v))
+		}
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []int16 // nil when decoding must fail
+		rate    int
+		channel int
+	}{
+		{
+			name: "wav 8-bit unsigned",
+			data: wavFile(wavFormatPCM, 1, 8000, 8, []byte{0x80, 0xFF, 0x00}),
+			want: []int16{0, 127 << 8, -128 << 8}, rate: 8000, channel: 1,
+		},
+		{
+			name: "wav 24-bit",
+			data: wavFile(wavFormatPCM, 1, 8000, 24, []byte{0x00, 0x34, 0x12, 0x00, 0x00, 0x80}),
+			want: []int16{0x1234, math.MinInt16}, rate: 8000, channel: 1,
+		},
+		{
+			name: "wav 32-bit float clipped",
+			data: wavFile(wavFormatFloat, 1, 8000, 32, float(binary.LittleEndian, 0, 2, -0.5)),
+			want: []int16{0, math.MaxInt16, -math.MaxInt16 / 2}, rate: 8000, channel: 1,
+		},
+		{
+			name: "wav data chunk longer than the file",
+			data: func() []byte {
+				b := wavFile(wavFormatPCM, 1, 8000, 16, []byte{1, 0, 2, 0})
+				binary.LittleEndian.PutUint32(b[len(b)-8:], 1000)
+				return b
+			}(),
+			want: []int16{1, 2}, rate: 8000, channel: 1,
+		},
+		{
+			name: "wav ends mid-frame",
+			data: wavFile(wavFormatPCM, 2, 8000, 16, []byte{1, 0, 2, 0, 3}),
+			want: []int16{1, 2}, rate: 8000, channel: 2,
+		},
+		{
+			name: "wav 16-bit float",
+			data: wavFile(wavFormatFloat, 1, 8000, 16, []byte{0, 0, 0, 0}),
+		},
+		{
+			name: "wav 12-bit",
+			data: wavFile(wavFormatPCM, 1, 8000, 12, []byte{0, 0, 0, 0}),
+		},
+		{
+			name: "wav no channels",
+			data: wavFile(wavFormatPCM, 0, 8000, 16, []byte{0, 0}),
+		},
+		{
+			name: "wav zero sample rate",
+			data: wavFile(wavFormatPCM, 1, 0, 16, []byte{0, 0}),
+		},
+		{
+			name: "wav short fmt chunk",
+			data: append([]byte("RIFF\x10\x00\x00\x00WAVE"), riffChunk(binary.LittleEndian, "fmt ", []byte{1, 0})...),
+		},
+		{
+			name: "wav missing data chunk",
+			data: wavFile(wavFormatPCM, 1, 8000, 16, nil)[:36],
+		},
+		{
+			name: "aiff 16-bit",
+			data: aiffFile("", 1, 16, 44100, []byte{0x12, 0x34, 0xFF, 0xFF}),
+			want: []int16{0x1234, -1}, rate: 44100, channel: 1,
+		},
+		{
+			name: "aifc sowt",
+			data: aiffFile("sowt", 1, 16, 44100, []byte{0x34, 0x12}),
+			want: []int16{0x1234}, rate: 44100, channel: 1,
+		},
+		{
+			name: "aifc fl32",
+			data: aiffFile("fl32", 1, 32, 44100, float(binary.BigEndian, 0.5)),
+			want: []int16{math.MaxInt16 / 2}, rate: 44100, channel: 1,
+		},
+		{
+			name: "aifc fl32 claiming 16-bit samples",
+			data: aiffFile("fl32", 1, 16, 44100, []byte{0x3F, 0x00, 0x00}),
+		},
+		{
+			name: "aifc fl32 claiming 8-bit samples",
+			data: aiffFile("fl32", 2, 8, 44100, []byte{0x3F}),
+		},
+		{
+			name: "aifc compressed",
+			data: aiffFile("ima4", 1, 16, 44100, []byte{0, 0}),
+		},
+		{
+			name: "aiff 4-bit",
+			data: aiffFile("", 1, 4, 44100, []byte{0, 0}),
+		},
+		{
+			name: "aiff zero sample rate",
+			data: aiffFile("", 1, 16, 0, []byte{0, 0}),
+		},
+		{
+			name: "aiff sound offset past the chunk",
+			data: func() []byte {
+				b := aiffFile("", 1, 16, 44100, []byte{0, 0})
+				binary.BigEndian.PutUint32(b[len(b)-10:], 100)
+				return b
+			}(),
+		},
+		{
+			name: "not audio",
+			data: []byte("ID3\x04\x00\x00\x00\x00\x00\x00\x00\x00"),
+		},
+		{
+			name: "empty",
+			data: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodePCM(tt.data)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("decodePCM = %+v, want an error", got)
+				}
+				if !errors.Is(err, errUnknownAudio) {
+					t.Errorf("decodePCM error = %v, want errUnknownAudio", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodePCM: %v", err)
+			}
+			if got.SampleRate != tt.rate || got.Channels != tt.channel {
+				t.Errorf("format = %d Hz, %d channels, want %d Hz, %d channels", got.SampleRate, got.Channels, tt.rate, tt.channel)
+			}
+			if !reflect.DeepEqual(got.Samples, tt.want) {
+				t.Errorf("samples = %v, want %v", got.Samples, tt.want)
+			}
+		})
+	}
+}
+
+// TestDecodePCMTruncated cuts valid files short at every length: decoding
+// may fail but must not panic.
+func TestDecodePCMTruncated(t *testing.T) {
+	files := map[string][]byte{
+		"wav":  encodeWAV(testTone()),
+		"aiff": encodeAIFF(testTone()),
+		"aifc": aiffFile("fl32", 2, 32, 22050, bytes.Repeat([]byte{0x3F, 0, 0, 0}, 4)),
+	}
+	for name, data := range files {
+		for n := 0; n < len(data); n++ {
+			if p, err := decodePCM(data[:n]); err == nil && len(p.Samples)%p.Channels != 0 {
+				t.Errorf("%s cut to %d bytes: %d samples for %d channels", name, n, len(p.Samples), p.Channels)
+			}
+		}
+	}
+}
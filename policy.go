@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// --------------- Interruption Policy ---------------
+
+// What a player is doing before an announcement, as far as interrupting it
+// is concerned.
+const (
+	mediaIdle   = "idle"    // stopped, paused or nothing loaded
+	mediaMusic  = "music"   // the queue or a single track
+	mediaRadio  = "radio"   // a live stream
+	mediaTV     = "tv"      // a soundbar's TV input
+	mediaLineIn = "line-in" // a line-in input
+)
+
+// Whether an announcement may take over a player.
+const (
+	// policyInterrupt always plays and restores the source afterwards.
+	policyInterrupt = "interrupt"
+	// policySkip leaves players on their TV or line-in input alone. Taking
+	// over an input disconnects it until the source is selected again.
+	policySkip = "skip"
+	// policyIdle only plays on players that are idle.
+	policyIdle = "idle"
+)
+
+var (
+	// defaultInterruptPolicy is the INTERRUPT_POLICY setting, used for
+	// speakers without their own entry.
+	defaultInterruptPolicy = policySkip
+	// interruptPolicies holds the INTERRUPT_POLICIES entries, keyed by
+	// lower-case speaker ID, alias or room name.
+	interruptPolicies map[string]string
+)
+
+// classifySource tells what a player was doing from its snapshot. Inputs
+// count as such even when silent, since replacing them disconnects them
+// all the same.
+func classifySource(snap *playbackSnapshot) string {
+	switch {
+	case strings.HasPrefix(snap.URI, "x-sonos-htastream:"):
+		return mediaTV
+	case strings.HasPrefix(snap.URI, "x-rincon-stream:"):
+		return mediaLineIn
+	case snap.URI == "" || !snap.wasPlaying():
+		return mediaIdle
+	case !seekableURI(snap.URI):
+		return mediaRadio
+	}
+	return mediaMusic
+}
+
+// liveInput reports whether uri is a TV or line-in input, which only passes
+// audio through while playing.
+func liveInput(uri string) bool {
+	return strings.HasPrefix(uri, "x-sonos-htastream:") || strings.HasPrefix(uri, "x-rincon-stream:")
+}
+
+func parseInterruptPolicy(v string) (string, error) {
+	switch p := strings.ToLower(strings.TrimSpace(v)); p {
+	case policyInterrupt, policySkip, policyIdle:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown interrupt policy %q, use %q, %q or %q", v, policyInterrupt, policySkip, policyIdle)
+}
+
+// loadInterruptPolicies reads INTERRUPT_POLICY and INTERRUPT_POLICIES, a
+// comma-separated list of speaker=policy pairs such as
+// "kitchen=idle,Living Room=interrupt".
+func loadInterruptPolicies() (string, map[string]string) {
+	def := policySkip
+	if v := os.Getenv("INTERRUPT_POLICY"); v != "" {
+		if p, err := parseInterruptPolicy(v); err != nil {
+			log.Printf("Invalid INTERRUPT_POLICY: %v, using %s", err, policySkip)
+		} else {
+			def = p
+		}
+	}
+
+	perSpeaker := make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("INTERRUPT_POLICIES"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, v, found := strings.Cut(entry, "=")
+		p, err := parseInterruptPolicy(v)
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !found || err != nil || name == "" {
+			log.Printf("Invalid INTERRUPT_POLICIES entry %q, expected speaker=%s|%s|%s", entry, policyInterrupt, policySkip, policyIdle)
+			continue
+		}
+		perSpeaker[name] = p
+	}
+	return def, perSpeaker
+}
+
+// interruptPolicyFor returns the policy of a speaker: its own entry, or
+// INTERRUPT_POLICY.
+func interruptPolicyFor(s *SonosSpeaker) string {
+	for _, key := range []string{s.ID, s.Alias, s.Name} {
+		if p, ok := interruptPolicies[strings.ToLower(key)]; ok {
+			return p
+		}
+	}
+	return defaultInterruptPolicy
+}
+
+// skipReason explains why policy keeps an announcement off a player doing
+// source, or returns "" if it may play.
+func skipReason(policy, source string) string {
+	skip := (policy == policySkip && (source == mediaTV || source == mediaLineIn)) ||
+		(policy == policyIdle && source != mediaIdle)
+	if !skip {
+		return ""
+	}
+	doing := "playing " + source
+	switch source {
+	case mediaTV:
+		doing = "on its TV input"
+	case mediaLineIn:
+		doing = "on line-in"
+	}
+	return fmt.Sprintf("speaker is %s (interrupt policy %s)", doing, policy)
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------- Announcement Queue ---------------
+
+// Announcements are serialized per speaker: an announcement starts once
+// every speaker it plays on is free, so two announcements never fight over
+// the same transport. Waiting announcements are ordered by priority, then by
+// arrival. A waiting announcement also reserves its speakers against
+// lower-ranked ones, so a multi-room announcement is not starved by a stream
+// of single-room ones.
+
+// Announcement priorities. Higher ones jump ahead in the queue; urgent ones
+// also cut off lower-priority announcements playing on their speakers.
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+	priorityUrgent
+)
+
+var priorityNames = []string{"low", "normal", "high", "urgent"}
+
+// Where an announcement is in its life.
+const (
+	announcementQueued      = "queued"
+	announcementPlaying     = "playing"
+	announcementCompleted   = "completed"   // played on every speaker
+	announcementPartial     = "partial"     // played on some speakers
+	announcementFailed      = "failed"      // played nowhere
+	announcementExpired     = "expired"     // waited longer than its expiry
+	announcementCancelled   = "cancelled"   // withdrawn by the caller
+	announcementInterrupted = "interrupted" // cut off by an urgent announcement
+	announcementSkipped     = "skipped"     // kept off every speaker by the interrupt policy
+)
+
+const (
+	defaultAnnounceExpiry = 5 * time.Minute
+	// announcementHistorySize is how many finished announcements are kept
+	// for GET /announcements.
+	announcementHistorySize = 50
+)
+
+// announceExpiry is the ANNOUNCE_EXPIRY setting.
+var announceExpiry = defaultAnnounceExpiry
+
+var (
+	errAnnouncementExpired     = errors.New("announcement expired in the queue")
+	errAnnouncementCancelled   = errors.New("announcement cancelled")
+	errAnnouncementInterrupted = errors.New("interrupted by an urgent announcement")
+	errAnnouncementSkipped     = errors.New("interrupt policy skipped every speaker")
+)
+
+// announcement is one queued, playing or finished announcement. The guarded
+// fields only change under announcementsMu, and not at all once done is
+// closed, so waiters may read them without the lock afterwards.
+type announcement struct {
+	ID      string
+	Text    string // empty for media played through /play
+	Media   string // uploaded file name or URL of /play
+	Target  string
+	Opts    announceOptions
+	Clip    clip
+	Created time.Time
+	Expires time.Time
+
+	// Guarded by announcementsMu.
+	Status      string
+	Started     time.Time
+	Finished    time.Time
+	Results     []playbackResult
+	Err         error
+	speakerIDs  []string // speakers held while playing
+	cancel      context.CancelCauseFunc
+	interrupted bool
+
+	stops speakerStops // speakers that can be stopped by themselves
+
+	done chan struct{} // closed when the announcement is finished
+}
+
+var (
+	// announcementQueue holds the waiting announcements in the order they
+	// will be considered: by priority, then by arrival.
+	announcementQueue   []*announcement
+	busySpeakers        = make(map[string]*announcement) // speaker ID -> announcement playing on it
+	announcementsByID   = make(map[string]*announcement)
+	announcementHistory []*announcement // finished, oldest first
+	announcementsMu     sync.Mutex
+)
+
+// parsePriority validates a priority name; empty means normal.
+func parsePriority(v string) (int, error) {
+	if v == "" {
+		return priorityNormal, nil
+	}
+	for p, name := range priorityNames {
+		if strings.EqualFold(v, name) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid priority %q: must be %s", v, strings.Join(priorityNames, ", "))
+}
+
+// enqueueAnnouncement renders text and queues it for target. Unknown
+// targets fail right away; the speakers are resolved again when the
+// announcement's turn comes, since groups may change while it waits.
+func enqueueAnnouncement(ctx context.Context, text, target string, opts announceOptions) (*announcement, error) {
+	if err := checkAnnounceTarget(target); err != nil {
+		return nil, err
+	}
+
+	opts.Chime = chimeFor(opts)
+	mp3Path, err := generateTTS(ctx, text, opts.Chime)
+	if err != nil {
+		return nil, err
+	}
+	title := opts.Title
+	if title == "" {
+		title = clipTitle(text)
+	}
+	a := &announcement{Text: text, Target: target, Opts: opts, Clip: newClip(mp3Path, title)}
+	queueAnnouncement(a)
+	return a, nil
+}
+
+// enqueueMedia queues a stored upload or an external URL for target. media
+// names it in the API: the uploaded file name or the URL.
+func enqueueMedia(media, target string, opts announceOptions, c clip) (*announcement, error) {
+	if err := checkAnnounceTarget(target); err != nil {
+		return nil, err
+	}
+	// Chimes are joined onto speech before encoding; media is played as is.
+	opts.Chime = ""
+	a := &announcement{Media: media, Target: target, Opts: opts, Clip: c}
+	queueAnnouncement(a)
+	return a, nil
+}
+
+func checkAnnounceTarget(target string) error {
+	refreshTopologyIfStale()
+	speakersMu.RLock()
+	defer speakersMu.RUnlock()
+	_, err := announceTargetsLocked(target)
+	return err
+}
+
+// queueAnnouncement files a new announcement behind those of the same or
+// higher priority and starts it if its speakers are free.
+func queueAnnouncement(a *announcement) {
+	expiry := a.Opts.Expiry
+	if expiry <= 0 {
+		expiry = announceExpiry
+	}
+	now := time.Now()
+	a.ID = newAnnouncementID()
+	a.Created = now
+	a.Expires = now.Add(expiry)
+	a.Status = announcementQueued
+	a.done = make(chan struct{})
+	opts := a.Opts
+
+	announcementsMu.Lock()
+	i := len(announcementQueue)
+	for i > 0 && announcementQueue[i-1].Opts.Priority < opts.Priority {
+		i--
+	}
+	announcementQueue = append(announcementQueue, nil)
+	copy(announcementQueue[i+1:], announcementQueue[i:])
+	announcementQueue[i] = a
+	announcementsByID[a.ID] = a
+	log.Printf("Queued announcement %s (%s priority, position %d)", a.ID, priorityNames[opts.Priority], i+1)
+	scheduleAnnouncementsLocked()
+	announcementsMu.Unlock()
+
+	// Drop it on time even if nothing else happens in the meantime.
+	time.AfterFunc(expiry, scheduleAnnouncements)
+}
+
+// label is the announcement's text, quoted, or its media.
+func (a *announcement) label() string {
+	if a.Media != "" {
+		return a.Media
+	}
+	return strconv.Quote(a.Text)
+}
+
+// wait blocks until the announcement is finished. If ctx ends first the
+// announcement is cancelled, and wait still returns only once its speakers
+// have been restored.
+func (a *announcement) wait(ctx context.Context) error {
+	select {
+	case <-a.done:
+	case <-ctx.Done():
+		cancelAnnouncement(a)
+		<-a.done
+	}
+	return a.Err
+}
+
+// cancelAnnouncement withdraws a waiting announcement or stops a playing
+// one. It reports false if the announcement had already finished.
+func cancelAnnouncement(a *announcement) bool {
+	announcementsMu.Lock()
+	defer announcementsMu.Unlock()
+	switch a.Status {
+	case announcementQueued:
+		for i, q := range announcementQueue {
+			if q == a {
+				announcementQueue = append(announcementQueue[:i], announcementQueue[i+1:]...)
+				break
+			}
+		}
+		a.finishLocked(announcementCancelled, nil, errAnnouncementCancelled)
+		// Speakers it reserved may now be free for others.
+		scheduleAnnouncementsLocked()
+		return true
+	case announcementPlaying:
+		a.cancel(errAnnouncementCancelled)
+		return true
+	}
+	return false
+}
+
+func scheduleAnnouncements() {
+	announcementsMu.Lock()
+	defer announcementsMu.Unlock()
+	scheduleAnnouncementsLocked()
+}
+
+// scheduleAnnouncementsLocked drops expired announcements, interrupts what
+// urgent ones are waiting for, and starts every announcement whose speakers
+// are free. The caller must hold announcementsMu.
+func scheduleAnnouncementsLocked() {
+	now := time.Now()
+	reserved := make(map[string]bool)
+	waiting := announcementQueue[:0]
+
+	for _, a := range announcementQueue {
+		if now.After(a.Expires) {
+			log.Printf("Announcement %s expired after waiting %s", a.ID, now.Sub(a.Created).Round(time.Second))
+			a.finishLocked(announcementExpired, nil, errAnnouncementExpired)
+			continue
+		}
+		targets, parts, err := resolveAnnouncementTargets(a.Target, a.Opts.Mode)
+		if err != nil {
+			a.finishLocked(announcementFailed, nil, err)
+			continue
+		}
+		ids := announcementSpeakerIDs(targets, parts)
+
+		blocked := false
+		for _, id := range ids {
+			if reserved[id] {
+				blocked = true
+			}
+			if b := busySpeakers[id]; b != nil {
+				blocked = true
+				if a.Opts.Priority == priorityUrgent && b.Opts.Priority < priorityUrgent && !b.interrupted {
+					log.Printf("Urgent announcement %s interrupts %s", a.ID, b.ID)
+					b.interrupted = true
+					b.cancel(errAnnouncementInterrupted)
+				}
+			}
+		}
+		for _, id := range ids {
+			reserved[id] = true
+		}
+		if blocked {
+			waiting = append(waiting, a)
+			continue
+		}
+
+		ctx, cancel := context.WithCancelCause(context.Background())
+		a.Status = announcementPlaying
+		a.Started = now
+		a.speakerIDs = ids
+		a.cancel = cancel
+		for _, id := range ids {
+			busySpeakers[id] = a
+		}
+		go runAnnouncement(ctx, a, targets, parts)
+	}
+
+	// Clear the tail so finished announcements can be collected.
+	for i := len(waiting); i < len(announcementQueue); i++ {
+		announcementQueue[i] = nil
+	}
+	announcementQueue = waiting
+}
+
+// runAnnouncement plays a started announcement, then frees its speakers for
+// whatever is waiting on them.
+func runAnnouncement(ctx context.Context, a *announcement, targets []*SonosSpeaker, parts []*groupParticipant) {
+	log.Printf("Playing announcement %s: %s -> %s", a.ID, a.label(), a.Target)
+	results, err := playAnnouncement(ctx, a, targets, parts)
+
+	announcementsMu.Lock()
+	defer announcementsMu.Unlock()
+	for _, id := range a.speakerIDs {
+		if busySpeakers[id] == a {
+			delete(busySpeakers, id)
+		}
+	}
+
+	status := announcementCompleted
+	switch {
+	case a.interrupted:
+		status = announcementInterrupted
+		err = errAnnouncementInterrupted
+	case ctx.Err() != nil:
+		status = announcementCancelled
+		err = errAnnouncementCancelled
+	case err != nil && !anyPlayed(results):
+		status = announcementFailed
+	case len(results) > 0 && !anyPlayed(results):
+		status = announcementSkipped
+		err = errAnnouncementSkipped
+	case err != nil:
+		status = announcementPartial
+	}
+	a.cancel(nil)
+	a.finishLocked(status, results, err)
+	scheduleAnnouncementsLocked()
+}
+
+// finishLocked records the outcome, wakes up waiters and moves the
+// announcement to the history. The caller must hold announcementsMu.
+func (a *announcement) finishLocked(status string, results []playbackResult, err error) {
+	a.Status = status
+	a.Finished = time.Now()
+	a.Results = results
+	a.Err = err
+	close(a.done)
+
+	announcementHistory = append(announcementHistory, a)
+	if n := len(announcementHistory) - announcementHistorySize; n > 0 {
+		for _, old := range announcementHistory[:n] {
+			delete(announcementsByID, old.ID)
+		}
+		announcementHistory = append([]*announcement(nil), announcementHistory[n:]...)
+	}
+}
+
+// announcementSpeakerIDs lists the speakers an announcement occupies: the
+// targeted coordinators, or in group mode every player that joins.
+func announcementSpeakerIDs(targets []*SonosSpeaker, parts []*groupParticipant) []string {
+	var ids []string
+	if parts != nil {
+		for _, p := range parts {
+			ids = append(ids, p.speaker.ID)
+		}
+		return ids
+	}
+	for _, s := range targets {
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+func newAnnouncementID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// --------------- Announcement API ---------------
+
+// announcementJSON is an announcement as reported by the API.
+type announcementJSON struct {
+	ID         string           `json:"id"`
+	Text       string           `json:"text,omitempty"`
+	Media      string           `json:"media,omitempty"`
+	Target     string           `json:"target"`
+	Mode       string           `json:"mode"`
+	Priority   string           `json:"priority"`
+	Chime      string           `json:"chime,omitempty"`
+	Status     string           `json:"status"`
+	Position   int              `json:"position,omitempty"` // 1-based place in the queue while queued
+	CreatedAt  string           `json:"created_at"`
+	ExpiresAt  string           `json:"expires_at,omitempty"`
+	StartedAt  string           `json:"started_at,omitempty"`
+	FinishedAt string           `json:"finished_at,omitempty"`
+	Results    []playbackResult `json:"results,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// announcementJSONLocked renders a. The caller must hold announcementsMu.
+func announcementJSONLocked(a *announcement) announcementJSON {
+	j := announcementJSON{
+		ID:        a.ID,
+		Text:      a.Text,
+		Media:     a.Media,
+		Target:    a.Target,
+		Mode:      a.Opts.Mode,
+		Priority:  priorityNames[a.Opts.Priority],
+		Chime:     a.Opts.Chime,
+		Status:    a.Status,
+		CreatedAt: a.Created.Format(resultTimeFormat),
+		Results:   a.Results,
+	}
+	if a.Status == announcementQueued {
+		j.ExpiresAt = a.Expires.Format(resultTimeFormat)
+		for i, q := range announcementQueue {
+			if q == a {
+				j.Position = i + 1
+			}
+		}
+	}
+	if !a.Started.IsZero() {
+		j.StartedAt = a.Started.Format(resultTimeFormat)
+	}
+	if !a.Finished.IsZero() {
+		j.FinishedAt = a.Finished.Format(resultTimeFormat)
+	}
+	if a.Err != nil {
+		j.Error = a.Err.Error()
+	}
+	return j
+}
+
+type announcementsResponse struct {
+	Announcements []announcementJSON `json:"announcements"`
+}
+
+// handleAnnouncements serves GET /announcements: playing announcements,
+// then the queue in playing order, then the most recent finished ones.
+func handleAnnouncements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	announcementsMu.Lock()
+	resp := announcementsResponse{Announcements: []announcementJSON{}}
+	var playing []*announcement
+	seen := make(map[*announcement]bool)
+	for _, a := range busySpeakers {
+		if !seen[a] {
+			seen[a] = true
+			playing = append(playing, a)
+		}
+	}
+	sort.Slice(playing, func(i, j int) bool { return playing[i].Started.Before(playing[j].Started) })
+	for _, a := range playing {
+		resp.Announcements = append(resp.Announcements, announcementJSONLocked(a))
+	}
+	for _, a := range announcementQueue {
+		resp.Announcements = append(resp.Announcements, announcementJSONLocked(a))
+	}
+	for i := len(announcementHistory) - 1; i >= 0; i-- {
+		resp.Announcements = append(resp.Announcements, announcementJSONLocked(announcementHistory[i]))
+	}
+	announcementsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleAnnouncementDetail serves GET /announcements/{id}.
+func handleAnnouncementDetail(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/announcements/"), "/")
+	if action != "" && action != "cancel" {
+		http.NotFound(w, r)
+		return
+	}
+
+	announcementsMu.Lock()
+	a, ok := announcementsByID[id]
+	var resp announcementJSON
+	if ok {
+		resp = announcementJSONLocked(a)
+	}
+	announcementsMu.Unlock()
+	if !ok {
+		http.Error(w, "announcement not found", http.StatusNotFound)
+		return
+	}
+
+	if action == "cancel" {
+		handleCancelAnnouncement(w, r, a)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
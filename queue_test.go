@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueBackend plays announcements without speakers. The one titled
+// "blocker" plays until the test releases it or it is cancelled; all others
+// finish right away. It records the order announcements start in.
+type queueBackend struct {
+	release chan struct{}
+
+	mu      sync.Mutex
+	started []string
+}
+
+func (*queueBackend) name() string { return "test" }
+
+func (b *queueBackend) play(ctx context.Context, targets []*SonosSpeaker, parts []*groupParticipant, req playbackRequest) ([]playbackResult, error) {
+	b.mu.Lock()
+	b.started = append(b.started, req.clip.Title)
+	b.mu.Unlock()
+
+	status := clipPlayed
+	if req.clip.Title == "blocker" {
+		select {
+		case <-b.release:
+		case <-ctx.Done():
+			status = clipCancelled
+		}
+	}
+	results := make([]playbackResult, len(targets))
+	for i, s := range targets {
+		results[i] = newPlaybackResult(s, clipProgress{Status: status})
+	}
+	return results, nil
+}
+
+// useTestQueue replaces the speakers, the playback backend and the queue
+// state with fresh ones for the duration of the test.
+func useTestQueue(t *testing.T, names ...string) *queueBackend {
+	t.Helper()
+	b := &queueBackend{release: make(chan struct{})}
+	oldSpeakers, oldPlayback := speakers, playback
+
+	speakersMu.Lock()
+	speakers = make(map[string]*SonosSpeaker)
+	for _, name := range names {
+		speakers[name] = &SonosSpeaker{Name: name, ID: name, Alias: speakerAlias(name), Online: true}
+	}
+	speakersMu.Unlock()
+	playback = b
+	resetQueue := func() {
+		announcementsMu.Lock()
+		announcementQueue = nil
+		busySpeakers = make(map[string]*announcement)
+		announcementsByID = make(map[string]*announcement)
+		announcementHistory = nil
+		announcementsMu.Unlock()
+	}
+	resetQueue()
+
+	t.Cleanup(func() {
+		resetQueue()
+		speakersMu.Lock()
+		speakers = oldSpeakers
+		speakersMu.Unlock()
+		playback = oldPlayback
+	})
+	return b
+}
+
+func TestAnnouncementQueue(t *testing.T) {
+	type queued struct {
+		title    string
+		target   string
+		priority int
+		expiry   time.Duration
+	}
+	tests := []struct {
+		name string
+		// blocker plays on its target first and holds it until the others
+		// are queued, cancel is withdrawn and wait has passed.
+		blocker queued
+		queued  []queued
+		cancel  string
+		wait    time.Duration
+		// wantEarly lists the announcements that play while the blocker
+		// does, wantOrder those started after it, in order.
+		wantEarly  []string
+		wantOrder  []string
+		wantStatus map[string]string
+	}{
+		{
+			name:      "priority order",
+			blocker:   queued{"blocker", "a", priorityNormal, 0},
+			queued:    []queued{{"low", "a", priorityLow, 0}, {"normal", "a", priorityNormal, 0}, {"high", "a", priorityHigh, 0}, {"high 2", "a", priorityHigh, 0}},
+			wantOrder: []string{"high", "high 2", "normal", "low"},
+			wantStatus: map[string]string{
+				"blocker": announcementCompleted,
+				"low":     announcementCompleted,
+				"normal":  announcementCompleted,
+				"high":    announcementCompleted,
+				"high 2":  announcementCompleted,
+			},
+		},
+		{
+			name:      "urgent interrupts a playing announcement",
+			blocker:   queued{"blocker", "a", priorityHigh, 0},
+			queued:    []queued{{"urgent", "a", priorityUrgent, 0}},
+			wantOrder: []string{"urgent"},
+			wantStatus: map[string]string{
+				"blocker": announcementInterrupted,
+				"urgent":  announcementCompleted,
+			},
+		},
+		{
+			name:    "urgent waits for another urgent one",
+			blocker: queued{"blocker", "a", priorityUrgent, 0},
+			queued:  []queued{{"urgent", "a", priorityUrgent, 0}},
+			// The blocker would not end if it were not released, so reaching
+			// the end at all shows it was not interrupted.
+			wantOrder: []string{"urgent"},
+			wantStatus: map[string]string{
+				"blocker": announcementCompleted,
+				"urgent":  announcementCompleted,
+			},
+		},
+		{
+			name:    "reservation keeps a lower priority from starving a higher one",
+			blocker: queued{"blocker", "a", priorityNormal, 0},
+			// "b" is free, but "both" waits for it along with "a".
+			queued:    []queued{{"both", "a,b", priorityHigh, 0}, {"b only", "b", priorityLow, 0}},
+			wantOrder: []string{"both", "b only"},
+			wantStatus: map[string]string{
+				"blocker": announcementCompleted,
+				"both":    announcementCompleted,
+				"b only":  announcementCompleted,
+			},
+		},
+		{
+			name:      "free speakers start right away",
+			blocker:   queued{"blocker", "a", priorityNormal, 0},
+			queued:    []queued{{"b only", "b", priorityLow, 0}},
+			wantEarly: []string{"b only"},
+			wantStatus: map[string]string{
+				"blocker": announcementCompleted,
+				"b only":  announcementCompleted,
+			},
+		},
+		{
+			name:      "expiry while queued",
+			blocker:   queued{"blocker", "a", priorityNormal, 0},
+			queued:    []queued{{"short", "a", priorityHigh, 20 * time.Millisecond}, {"long", "a", priorityNormal, 0}},
+			wait:      100 * time.Millisecond,
+			wantOrder: []string{"long"},
+			wantStatus: map[string]string{
+				"blocker": announcementCompleted,
+				"short":   announcementExpired,
+				"long":    announcementCompleted,
+			},
+		},
+		{
+			name:      "cancel a queued announcement",
+			blocker:   queued{"blocker", "a", priorityNormal, 0},
+			queued:    []queued{{"cancelled", "a", priorityHigh, 0}, {"kept", "a", priorityNormal, 0}},
+			cancel:    "cancelled",
+			wantOrder: []string{"kept"},
+			wantStatus: map[string]string{
+				"blocker":   announcementCompleted,
+				"cancelled": announcementCancelled,
+				"kept":      announcementCompleted,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := useTestQueue(t, "a", "b")
+			all := make(map[string]*announcement)
+			queue := func(q queued) {
+				a := &announcement{
+					Target: q.target,
+					Opts:   announceOptions{Volume: noVolume, Priority: q.priority, Expiry: q.expiry},
+					Clip:   clip{Title: q.title},
+				}
+				queueAnnouncement(a)
+				all[q.title] = a
+			}
+
+			queue(tt.blocker)
+			for _, q := range tt.queued {
+				queue(q)
+			}
+			if tt.cancel != "" {
+				if !cancelAnnouncement(all[tt.cancel]) {
+					t.Fatalf("cancelAnnouncement(%q) = false, want true", tt.cancel)
+				}
+			}
+			time.Sleep(tt.wait)
+			for _, title := range tt.wantEarly {
+				select {
+				case <-all[title].done:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%q did not play while the blocker did", title)
+				}
+			}
+			b.mu.Lock()
+			var early []string
+			for _, title := range b.started {
+				if title != "blocker" {
+					early = append(early, title)
+				}
+			}
+			b.mu.Unlock()
+			if !reflect.DeepEqual(early, tt.wantEarly) {
+				t.Errorf("started while the blocker played: %v, want %v", early, tt.wantEarly)
+			}
+			close(b.release)
+
+			got := make(map[string]string)
+			for title, a := range all {
+				select {
+				case <-a.done:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%q still %s", title, a.Status)
+				}
+				got[title] = a.Status
+			}
+			if !reflect.DeepEqual(got, tt.wantStatus) {
+				t.Errorf("statuses = %v, want %v", got, tt.wantStatus)
+			}
+
+			b.mu.Lock()
+			var order []string
+			skip := len(early)
+			for _, title := range b.started {
+				switch {
+				case title == "blocker":
+				case skip > 0:
+					skip--
+				default:
+					order = append(order, title)
+				}
+			}
+			b.mu.Unlock()
+			if !reflect.DeepEqual(order, tt.wantOrder) {
+				t.Errorf("started after the blocker: %v, want %v", order, tt.wantOrder)
+			}
+		})
+	}
+}
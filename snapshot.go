@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// --------------- Playback Snapshot ---------------
+
+// playbackSnapshot is what a player was doing before an announcement took
+// over its transport.
+type playbackSnapshot struct {
+	TransportState string // PLAYING, PAUSED_PLAYBACK, STOPPED, ...
+	URI            string
+	MetaData       string
+	Track          int    // position in the queue, 1-based
+	RelTime        string // position in the track, H:MM:SS
+	Volume         int
+	HasVolume      bool
+}
+
+// wasPlaying reports whether the player should resume after the clip.
+func (p *playbackSnapshot) wasPlaying() bool {
+	return p.TransportState == "PLAYING" || p.TransportState == "TRANSITIONING"
+}
+
+// takeSnapshot records the current transport, media, position and volume of
+// a group coordinator.
+func takeSnapshot(ctx context.Context, s *SonosSpeaker) (*playbackSnapshot, error) {
+	transport, err := getTransportInfo(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	media, err := getMediaInfo(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	position, err := getPositionInfo(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &playbackSnapshot{
+		TransportState: transport.CurrentTransportState,
+		URI:            media.CurrentURI,
+		MetaData:       media.CurrentURIMetaData,
+		Track:          position.Track,
+		RelTime:        position.RelTime,
+	}
+
+	// A player without volume control (fixed line-out) still restores
+	// everything else.
+	if vol, err := getVolume(ctx, s); err != nil {
+		log.Printf("GetVolume on %s failed: %v", s.Name, err)
+	} else {
+		snap.Volume = vol
+		snap.HasVolume = true
+	}
+	return snap, nil
+}
+
+// restoreSnapshot puts the player back the way takeSnapshot found it: same
+// source, same queue position and offset, same volume, playing or paused.
+func restoreSnapshot(ctx context.Context, s *SonosSpeaker, snap *playbackSnapshot) error {
+	if snap.URI == "" {
+		// Nothing was loaded before; only the volume needs putting back.
+		return restoreVolume(ctx, s, snap)
+	}
+
+	if err := setAVTransportURI(ctx, s, snap.URI, snap.MetaData); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(snap.URI, "x-rincon-queue:") && snap.Track > 0 {
+		if err := seek(ctx, s, "TRACK_NR", strconv.Itoa(snap.Track)); err != nil {
+			return err
+		}
+	}
+	if seekableURI(snap.URI) && snap.RelTime != "" && snap.RelTime != "0:00:00" && snap.RelTime != "NOT_IMPLEMENTED" {
+		if err := seek(ctx, s, "REL_TIME", snap.RelTime); err != nil {
+			// Landing at the start of the right track is close enough.
+			log.Printf("Seek to %s on %s failed: %v", snap.RelTime, s.Name, err)
+		}
+	}
+
+	if err := restoreVolume(ctx, s, snap); err != nil {
+		return err
+	}
+
+	// An input only passes audio through while playing, whatever state it
+	// reported.
+	if snap.wasPlaying() || liveInput(snap.URI) {
+		if err := play(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreVolume(ctx context.Context, s *SonosSpeaker, snap *playbackSnapshot) error {
+	if !snap.HasVolume {
+		return nil
+	}
+	return setVolume(ctx, s, snap.Volume)
+}
+
+func seek(ctx context.Context, s *SonosSpeaker, unit, target string) error {
+	err := s.invoke(ctx, avTransportService, "Seek", seekArgs{Unit: unit, Target: target}, nil)
+	if err != nil {
+		return fmt.Errorf("%w (%s %s)", err, unit, target)
+	}
+	return nil
+}
+
+// seekableURI reports whether a position within the URI can be restored.
+// Radio and line-in streams are live; resuming them picks up the present.
+func seekableURI(uri string) bool {
+	for _, prefix := range []string{
+		"x-sonosapi-stream:", "x-sonosapi-radio:", "x-sonosapi-hls:",
+		"x-rincon-mp3radio:", "x-rincon-stream:", "x-sonos-htastream:",
+		"aac:", "hls-radio:",
+	} {
+		if strings.HasPrefix(uri, prefix) {
+			return false
+		}
+	}
+	return true
+}
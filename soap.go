@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --------------- UPnP SOAP Client ---------------
+
+const (
+	avTransportService       = "urn:schemas-upnp-org:service:AVTransport:1"
+	renderingControlService  = "urn:schemas-upnp-org:service:RenderingControl:1"
+	zoneGroupTopologyService = "urn:schemas-upnp-org:service:ZoneGroupTopology:1"
+)
+
+const (
+	defaultSOAPTimeout = 5 * time.Second
+	defaultSOAPRetries = 2
+	// soapRetryBackoff is the pause before the first retry; it doubles for
+	// every further one.
+	soapRetryBackoff = 250 * time.Millisecond
+)
+
+// soapTimeout bounds each attempt of an action and soapRetries is how many
+// times a transient failure is retried: the SOAP_TIMEOUT and SOAP_RETRIES
+// settings.
+var (
+	soapTimeout = defaultSOAPTimeout
+	soapRetries = defaultSOAPRetries
+)
+
+// soapClient carries no timeout of its own; every request is bounded by its
+// context instead.
+var soapClient = &http.Client{}
+
+// upnpError is a SOAP fault returned by a player, e.g. error 701 when Play
+// is sent to a transport with nothing loaded.
+type upnpError struct {
+	Service     string
+	Code        int
+	Description string // the player's own errorDescription, often empty
+}
+
+func (e *upnpError) Error() string {
+	meaning := upnpErrorMeaning(e.Service, e.Code)
+	switch {
+	case meaning == "" && e.Description == "":
+		return fmt.Sprintf("UPnP error %d", e.Code)
+	case meaning == "":
+		return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+	}
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, meaning)
+}
+
+// upnpErrorCode returns the UPnP error code in err's chain, or 0.
+func upnpErrorCode(err error) int {
+	var ue *upnpError
+	if errors.As(err, &ue) {
+		return ue.Code
+	}
+	return 0
+}
+
+// Error codes defined by the UPnP architecture for every service.
+var upnpCommonErrors = map[int]string{
+	401: "Invalid action",
+	402: "Invalid arguments",
+	403: "Out of sync",
+	501: "Action failed",
+	600: "Argument value invalid",
+	601: "Argument value out of range",
+	602: "Optional action not implemented",
+	603: "Out of memory",
+	604: "Human intervention required",
+	605: "String argument too long",
+}
+
+// Error codes of the individual services. The 7xx ranges overlap, so the
+// meaning depends on the service that raised it.
+var upnpServiceErrors = map[string]map[int]string{
+	avTransportService: {
+		701: "Transition not available",
+		702: "No contents",
+		703: "Read error",
+		704: "Format not supported for playback",
+		705: "Transport is locked",
+		706: "Write error",
+		707: "Media is protected or not writable",
+		708: "Format not supported for recording",
+		709: "Media is full",
+		710: "Seek mode not supported",
+		711: "Illegal seek target",
+		712: "Play mode not supported",
+		713: "Record quality not supported",
+		714: "Illegal MIME type",
+		715: "Content busy",
+		716: "Resource not found",
+		717: "Play speed not supported",
+		718: "Invalid InstanceID",
+		737: "No DNS server",
+		738: "Bad domain name",
+		739: "Server error",
+		800: "Not supported by this player (is it a group member?)",
+	},
+	renderingControlService: {
+		701: "Invalid name",
+		702: "Invalid InstanceID",
+	},
+}
+
+func upnpErrorMeaning(service string, code int) string {
+	if m, ok := upnpServiceErrors[service][code]; ok {
+		return m
+	}
+	return upnpCommonErrors[code]
+}
+
+// httpStatusError is a non-200 answer that carried no SOAP fault, e.g. from a
+// player that is still booting.
+type httpStatusError int
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d", int(e))
+}
+
+// soapFault is the body of a failed action.
+type soapFault struct {
+	Code        string `xml:"faultcode"`
+	String      string `xml:"faultstring"`
+	UPnPCode    string `xml:"detail>UPnPError>errorCode"`
+	Description string `xml:"detail>UPnPError>errorDescription"`
+}
+
+// soapInvoke posts action to a control URL. in is marshalled as the input
+// arguments (nil for none); the output arguments are decoded into out unless
+// it is nil. Each attempt is bounded by soapTimeout, and network errors,
+// timeouts and 5xx answers without a fault are retried with backoff until
+// ctx is done. Errors name the action; faults become *upnpError.
+func soapInvoke(ctx context.Context, url, service, action string, in, out any) error {
+	body, err := soapEnvelope(service, action, in)
+	if err != nil {
+		return fmt.Errorf("%s: %w", action, err)
+	}
+
+	backoff := soapRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = soapAttempt(ctx, url, service, action, body, out)
+		if err == nil {
+			return nil
+		}
+		if attempt >= soapRetries || !transientSOAPError(ctx, err) {
+			break
+		}
+		log.Printf("%s to %s failed, retrying in %s: %v", action, url, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", action, ctx.Err())
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("%s: %w", action, err)
+}
+
+func soapAttempt(ctx context.Context, url, service, action string, body []byte, out any) error {
+	attemptCtx, cancel := context.WithTimeout(ctx, soapTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(attemptCtx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", service+"#"+action)
+
+	resp, err := soapClient.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		var respBody []byte
+		if respBody, err = io.ReadAll(resp.Body); err == nil {
+			return decodeSOAPResponse(service, respBody, resp.StatusCode, out)
+		}
+	}
+	if ctx.Err() == nil && attemptCtx.Err() != nil {
+		return fmt.Errorf("no answer within %s", soapTimeout)
+	}
+	return err
+}
+
+// transientSOAPError reports whether an attempt is worth repeating. A fault
+// is the player's considered answer and is final, and nothing is retried
+// once the caller has given up.
+func transientSOAPError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var ue *upnpError
+	if errors.As(err, &ue) {
+		return false
+	}
+	var se httpStatusError
+	if errors.As(err, &se) {
+		return se >= 500
+	}
+	// Connection errors and attempt timeouts.
+	return true
+}
+
+// soapEnvelope wraps the marshalled input arguments of action in a SOAP
+// envelope. Arguments stay unqualified, as UPnP devices expect.
+func soapEnvelope(service, action string, in any) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"` +
+		` s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	if in == nil {
+		in = struct{}{}
+	}
+	enc := xml.NewEncoder(&buf)
+	start := xml.StartElement{
+		Name: xml.Name{Local: "u:" + action},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns:u"}, Value: service}},
+	}
+	if err := enc.EncodeElement(in, start); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	buf.WriteString(`</s:Body></s:Envelope>`)
+	return buf.Bytes(), nil
+}
+
+// decodeSOAPResponse turns a fault into a *upnpError and otherwise decodes
+// the first element of the body, the action response, into out.
+func decodeSOAPResponse(service string, body []byte, status int, out any) error {
+	var env struct {
+		Body struct {
+			Fault    *soapFault `xml:"Fault"`
+			Response struct {
+				XMLName xml.Name
+				Inner   []byte `xml:",innerxml"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	parseErr := xml.Unmarshal(body, &env)
+
+	if parseErr == nil && env.Body.Fault != nil {
+		f := env.Body.Fault
+		code, err := strconv.Atoi(f.UPnPCode)
+		if err != nil {
+			return fmt.Errorf("SOAP fault %s: %s", f.Code, f.String)
+		}
+		return &upnpError{Service: service, Code: code, Description: f.Description}
+	}
+	if status != http.StatusOK {
+		return httpStatusError(status)
+	}
+	if parseErr != nil {
+		return fmt.Errorf("bad SOAP response: %w", parseErr)
+	}
+	if out == nil {
+		return nil
+	}
+
+	wrapped := append(append([]byte("<r>"), env.Body.Response.Inner...), "</r>"...)
+	if err := xml.Unmarshal(wrapped, out); err != nil {
+		return fmt.Errorf("bad %s: %w", env.Body.Response.XMLName.Local, err)
+	}
+	return nil
+}
+
+// invoke calls action on the speaker's copy of service.
+func (s *SonosSpeaker) invoke(ctx context.Context, service, action string, in, out any) error {
+	return soapInvoke(ctx, s.controlURL(serviceShortName(service)), service, action, in, out)
+}
+
+// --------------- Typed Actions ---------------
+
+// instanceArgs is the input of every action that only takes an InstanceID.
+// Sonos players have a single instance, 0.
+type instanceArgs struct {
+	InstanceID int
+}
+
+type setAVTransportURIArgs struct {
+	InstanceID         int
+	CurrentURI         string
+	CurrentURIMetaData string
+}
+
+type playArgs struct {
+	InstanceID int
+	Speed      string
+}
+
+type seekArgs struct {
+	InstanceID int
+	Unit       string // TRACK_NR or REL_TIME
+	Target     string
+}
+
+type channelArgs struct {
+	InstanceID int
+	Channel    string
+}
+
+type setVolumeArgs struct {
+	InstanceID    int
+	Channel       string
+	DesiredVolume int
+}
+
+type transportInfo struct {
+	CurrentTransportState  string
+	CurrentTransportStatus string
+	CurrentSpeed           string
+}
+
+type mediaInfo struct {
+	NrTracks           int
+	MediaDuration      string
+	CurrentURI         string
+	CurrentURIMetaData string
+	PlayMedium         string
+}
+
+type positionInfo struct {
+	Track         int
+	TrackDuration string
+	TrackMetaData string
+	TrackURI      string
+	RelTime       string
+}
+
+type volumeInfo struct {
+	CurrentVolume int
+}
+
+type zoneGroupStateInfo struct {
+	ZoneGroupState string
+}
+
+func getTransportInfo(ctx context.Context, s *SonosSpeaker) (*transportInfo, error) {
+	var out transportInfo
+	if err := s.invoke(ctx, avTransportService, "GetTransportInfo", instanceArgs{}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func getMediaInfo(ctx context.Context, s *SonosSpeaker) (*mediaInfo, error) {
+	var out mediaInfo
+	if err := s.invoke(ctx, avTransportService, "GetMediaInfo", instanceArgs{}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func getPositionInfo(ctx context.Context, s *SonosSpeaker) (*positionInfo, error) {
+	var out positionInfo
+	if err := s.invoke(ctx, avTransportService, "GetPositionInfo", instanceArgs{}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func setAVTransportURI(ctx context.Context, s *SonosSpeaker, uri, metaData string) error {
+	return s.invoke(ctx, avTransportService, "SetAVTransportURI",
+		setAVTransportURIArgs{CurrentURI: uri, CurrentURIMetaData: metaData}, nil)
+}
+
+func play(ctx context.Context, s *SonosSpeaker) error {
+	return s.invoke(ctx, avTransportService, "Play", playArgs{Speed: "1"}, nil)
+}
+
+func stop(ctx context.Context, s *SonosSpeaker) error {
+	return s.invoke(ctx, avTransportService, "Stop", instanceArgs{}, nil)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// soapBody wraps inner in a SOAP envelope, as a player answers.
+func soapBody(inner string) []byte {
+	return []byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"` +
+		` s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` + inner + `</s:Body></s:Envelope>`)
+}
+
+// faultBody is the body of a failed action with a UPnP error code.
+func faultBody(code, description string) []byte {
+	desc := ""
+	if description != "" {
+		desc = "<errorDescription>" + description + "</errorDescription>"
+	}
+	return soapBody(`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>` +
+		`<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>` + code + `</errorCode>` + desc +
+		`</UPnPError></detail></s:Fault>`)
+}
+
+func TestDecodeSOAPResponseFaults(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		body    []byte
+		status  int
+		code    int    // 0 when the error is not a *upnpError
+		wantErr string // the error's text
+	}{
+		{
+			name:    "transition not available",
+			service: avTransportService,
+			body:    faultBody("701", ""),
+			status:  http.StatusInternalServerError,
+			code:    701,
+			wantErr: "UPnP error 701: Transition not available",
+		},
+		{
+			name:    "illegal MIME type",
+			service: avTransportService,
+			body:    faultBody("714", ""),
+			status:  http.StatusInternalServerError,
+			code:    714,
+			wantErr: "UPnP error 714: Illegal MIME type",
+		},
+		{
+			name:    "common error on another service",
+			service: renderingControlService,
+			body:    faultBody("402", ""),
+			status:  http.StatusInternalServerError,
+			code:    402,
+			wantErr: "UPnP error 402: Invalid arguments",
+		},
+		{
+			name:    "same code, other service",
+			service: renderingControlService,
+			body:    faultBody("701", ""),
+			status:  http.StatusInternalServerError,
+			code:    701,
+			wantErr: "UPnP error 701: Invalid name",
+		},
+		{
+			name:    "unknown code with the player's description",
+			service: avTransportService,
+			body:    faultBody("999", "Something odd"),
+			status:  http.StatusInternalServerError,
+			code:    999,
+			wantErr: "UPnP error 999: Something odd",
+		},
+		{
+			name:    "unknown code without description",
+			service: avTransportService,
+			body:    faultBody("999", ""),
+			status:  http.StatusInternalServerError,
+			code:    999,
+			wantErr: "UPnP error 999",
+		},
+		{
+			name:    "fault without a UPnP error",
+			service: avTransportService,
+			body:    soapBody(`<s:Fault><faultcode>s:Server</faultcode><faultstring>Boom</faultstring></s:Fault>`),
+			status:  http.StatusInternalServerError,
+			wantErr: "SOAP fault s:Server: Boom",
+		},
+		{
+			name:    "error status without a fault",
+			service: avTransportService,
+			body:    []byte("<html>Service Unavailable</html>"),
+			status:  http.StatusServiceUnavailable,
+			wantErr: "HTTP 503",
+		},
+		{
+			name:    "error status with an empty body",
+			service: avTransportService,
+			status:  http.StatusNotFound,
+			wantErr: "HTTP 404",
+		},
+		{
+			name:    "not XML",
+			service: avTransportService,
+			body:    []byte("garbage"),
+			status:  http.StatusOK,
+			wantErr: "bad SOAP response",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := decodeSOAPResponse(tt.service, tt.body, tt.status, nil)
+			if err == nil {
+				t.Fatal("decodeSOAPResponse succeeded, want an error")
+			}
+			if !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("error = %q, want %q", err, tt.wantErr)
+			}
+			if got := upnpErrorCode(err); got != tt.code {
+				t.Errorf("upnpErrorCode = %d, want %d", got, tt.code)
+			}
+			if tt.code != 0 {
+				var ue *upnpError
+				if errors.As(err, &ue) && ue.Service != tt.service {
+					t.Errorf("fault service = %q, want %q", ue.Service, tt.service)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeSOAPResponseOutput(t *testing.T) {
+	body := soapBody(`<u:GetTransportInfoResponse xmlns:u="urn:schemas-upnp-org:service:AVTransport:1">` +
+		`<CurrentTransportState>PLAYING</CurrentTransportState>` +
+		`<CurrentTransportStatus>OK</CurrentTransportStatus>` +
+		`<CurrentSpeed>1</CurrentSpeed></u:GetTransportInfoResponse>`)
+	var got transportInfo
+	if err := decodeSOAPResponse(avTransportService, body, http.StatusOK, &got); err != nil {
+		t.Fatalf("decodeSOAPResponse: %v", err)
+	}
+	want := transportInfo{CurrentTransportState: "PLAYING", CurrentTransportStatus: "OK", CurrentSpeed: "1"}
+	if got != want {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+
+	// Escaped metadata comes back as text.
+	body = soapBody(`<u:GetMediaInfoResponse xmlns:u="urn:schemas-upnp-org:service:AVTransport:1">` +
+		`<NrTracks>3</NrTracks><CurrentURI>x-rincon-queue:RINCON_1#0</CurrentURI>` +
+		`<CurrentURIMetaData>&lt;DIDL-Lite&gt;&lt;/DIDL-Lite&gt;</CurrentURIMetaData></u:GetMediaInfoResponse>`)
+	var media mediaInfo
+	if err := decodeSOAPResponse(avTransportService, body, http.StatusOK, &media); err != nil {
+		t.Fatalf("decodeSOAPResponse: %v", err)
+	}
+	wantMedia := mediaInfo{NrTracks: 3, CurrentURI: "x-rincon-queue:RINCON_1#0", CurrentURIMetaData: "<DIDL-Lite></DIDL-Lite>"}
+	if !reflect.DeepEqual(media, wantMedia) {
+		t.Errorf("decoded %+v, want %+v", media, wantMedia)
+	}
+
+	// An empty response is fine when no output is wanted.
+	body = soapBody(`<u:PlayResponse xmlns:u="urn:schemas-upnp-org:service:AVTransport:1"></u:PlayResponse>`)
+	if err := decodeSOAPResponse(avTransportService, body, http.StatusOK, nil); err != nil {
+		t.Errorf("decodeSOAPResponse without output: %v", err)
+	}
+
+	// Output that does not fit is an error naming the response.
+	body = soapBody(`<u:GetVolumeResponse xmlns:u="urn:schemas-upnp-org:service:RenderingControl:1">` +
+		`<CurrentVolume>loud</CurrentVolume></u:GetVolumeResponse>`)
+	var vol volumeInfo
+	err := decodeSOAPResponse(renderingControlService, body, http.StatusOK, &vol)
+	if err == nil || !strings.Contains(err.Error(), "GetVolumeResponse") {
+		t.Errorf("decodeSOAPResponse error = %v, want one naming GetVolumeResponse", err)
+	}
+}
+
+func TestTransientSOAPError(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"fault", context.Background(), &upnpError{Service: avTransportService, Code: 701}, false},
+		{"wrapped fault", context.Background(), fmt.Errorf("Play: %w", &upnpError{Code: 501}), false},
+		{"server error", context.Background(), httpStatusError(http.StatusServiceUnavailable), true},
+		{"client error", context.Background(), httpStatusError(http.StatusNotFound), false},
+		{"network error", context.Background(), netErr, true},
+		{"network error after the caller gave up", cancelled, netErr, false},
+		{"server error after the caller gave up", cancelled, httpStatusError(http.StatusInternalServerError), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transientSOAPError(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("transientSOAPError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSOAPInvokeRetries(t *testing.T) {
+	oldRetries := soapRetries
+	soapRetries = 1
+	t.Cleanup(func() { soapRetries = oldRetries })
+
+	tests := []struct {
+		name         string
+		status       int
+		body         []byte
+		wantAttempts int32
+		wantCode     int
+	}{
+		{"fault is final", http.StatusInternalServerError, faultBody("701", ""), 1, 701},
+		{"server error is retried", http.StatusServiceUnavailable, nil, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				if got := r.Header.Get("SOAPAction"); got != avTransportService+"#Play" {
+					t.Errorf("SOAPAction = %q", got)
+				}
+				w.WriteHeader(tt.status)
+				w.Write(tt.body)
+			}))
+			defer srv.Close()
+
+			err := soapInvoke(context.Background(), srv.URL, avTransportService, "Play", playArgs{Speed: "1"}, nil)
+			if err == nil || !strings.HasPrefix(err.Error(), "Play: ") {
+				t.Errorf("soapInvoke error = %v, want one naming the action", err)
+			}
+			if got := upnpErrorCode(err); got != tt.wantCode {
+				t.Errorf("upnpErrorCode = %d, want %d", got, tt.wantCode)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
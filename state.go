@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --------------- Live Speaker State ---------------
+
+// speakerState is the latest transport and rendering state a speaker
+// reported through GENA events.
+type speakerState struct {
+	TransportState string `json:"transport_state,omitempty"`
+	PlayMode       string `json:"play_mode,omitempty"`
+	URI            string `json:"uri,omitempty"`       // AVTransportURI
+	TrackURI       string `json:"track_uri,omitempty"` // CurrentTrackURI
+	Track          int    `json:"track,omitempty"`
+	NumTracks      int    `json:"num_tracks,omitempty"`
+	TrackDuration  string `json:"track_duration,omitempty"`
+	Volume         *int   `json:"volume,omitempty"`
+	Muted          *bool  `json:"muted,omitempty"`
+	UpdatedAt      string `json:"updated_at"` // RFC3339
+}
+
+var (
+	// speakerStates holds the event-fed state by speaker ID.
+	speakerStates   = make(map[string]*speakerState)
+	speakerStatesMu sync.RWMutex
+)
+
+// stateChange is one state variable from a LastChange event.
+type stateChange struct {
+	Name    string // e.g. TransportState, Volume
+	Channel string // RenderingControl channel, e.g. Master
+	Value   string
+}
+
+// lastChangeXML is the document carried in a LastChange property:
+//
+//	<Event xmlns="urn:schemas-upnp-org:metadata-1-0/AVT/">
+//	  <InstanceID val="0"><TransportState val="PLAYING"/>…</InstanceID>
+//	</Event>
+type lastChangeXML struct {
+	Instances []struct {
+		Val  string `xml:"val,attr"`
+		Vars []struct {
+			XMLName xml.Name
+			Channel string `xml:"channel,attr"`
+			Val     string `xml:"val,attr"`
+		} `xml:",any"`
+	} `xml:"InstanceID"`
+}
+
+// parseLastChange extracts the state changes of instance 0, the only one
+// Sonos players use.
+func parseLastChange(doc string) ([]stateChange, error) {
+	var ev lastChangeXML
+	if err := xml.Unmarshal([]byte(doc), &ev); err != nil {
+		return nil, fmt.Errorf("LastChange: %w", err)
+	}
+	var changes []stateChange
+	for _, inst := range ev.Instances {
+		if inst.Val != "0" {
+			continue
+		}
+		for _, v := range inst.Vars {
+			changes = append(changes, stateChange{Name: v.XMLName.Local, Channel: v.Channel, Value: v.Val})
+		}
+	}
+	return changes, nil
+}
+
+// applyStateChanges folds changes into the cached state of a speaker.
+func applyStateChanges(id string, changes []stateChange) {
+	speakerStatesMu.Lock()
+	defer speakerStatesMu.Unlock()
+
+	st, ok := speakerStates[id]
+	if !ok {
+		st = &speakerState{}
+		speakerStates[id] = st
+	}
+	for _, c := range changes {
+		st.apply(c)
+	}
+	st.UpdatedAt = time.Now().Format(time.RFC3339)
+}
+
+func (st *speakerState) apply(c stateChange) {
+	switch c.Name {
+	case "TransportState":
+		st.TransportState = c.Value
+	case "CurrentPlayMode":
+		st.PlayMode = c.Value
+	case "AVTransportURI":
+		st.URI = c.Value
+	case "CurrentTrackURI":
+		st.TrackURI = c.Value
+	case "CurrentTrack":
+		st.Track, _ = strconv.Atoi(c.Value)
+	case "NumberOfTracks":
+		st.NumTracks, _ = strconv.Atoi(c.Value)
+	case "CurrentTrackDuration":
+		st.TrackDuration = c.Value
+	case "Volume":
+		if c.Channel == "Master" {
+			if vol, err := strconv.Atoi(c.Value); err == nil {
+				st.Volume = &vol
+			}
+		}
+	case "Mute":
+		if c.Channel == "Master" {
+			muted := c.Value == "1"
+			st.Muted = &muted
+		}
+	}
+}
+
+// speakerStateFor returns a copy of the cached state, or nil if no event has
+// arrived from the speaker.
+func speakerStateFor(id string) *speakerState {
+	speakerStatesMu.RLock()
+	defer speakerStatesMu.RUnlock()
+
+	st, ok := speakerStates[id]
+	if !ok {
+		return nil
+	}
+	c := *st
+	return &c
+}
+
+func forgetSpeakerState(id string) {
+	speakerStatesMu.Lock()
+	delete(speakerStates, id)
+	speakerStatesMu.Unlock()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// --------------- Static Speaker Configuration ---------------
+
+// Where a speaker entry came from.
+const (
+	sourceDiscovery = "discovery"
+	sourceConfig    = "config"
+)
+
+// staticSpeakers holds the description URLs of speakers configured through
+// SONOS_SPEAKERS and SONOS_SPEAKERS_FILE.
+var staticSpeakers []string
+
+// loadStaticSpeakers reads speaker entries from the SONOS_SPEAKERS variable
+// (comma-separated) and the file named by SONOS_SPEAKERS_FILE (one entry per
+// line, # starts a comment). An entry is an IP, host:port or description URL.
+func loadStaticSpeakers() []string {
+	entries := strings.Split(os.Getenv("SONOS_SPEAKERS"), ",")
+
+	if path := os.Getenv("SONOS_SPEAKERS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("Cannot read SONOS_SPEAKERS_FILE: %v", err)
+		} else {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				line, _, _ := strings.Cut(scanner.Text(), "#")
+				entries = append(entries, line)
+			}
+			f.Close()
+		}
+	}
+
+	var locations []string
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		loc := speakerDescriptionURL(e)
+		if loc == "" || seen[loc] {
+			continue
+		}
+		seen[loc] = true
+		locations = append(locations, loc)
+	}
+	return locations
+}
+
+// speakerDescriptionURL turns a configured entry into a device description
+// URL: "192.168.1.10" and "192.168.1.10:1400" become
+// http://192.168.1.10:1400/xml/device_description.xml, full URLs are kept.
+func speakerDescriptionURL(entry string) string {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return ""
+	}
+	if strings.Contains(entry, "://") {
+		if baseURLOf(entry) == strings.TrimSuffix(entry, "/") {
+			return baseURLOf(entry) + "/xml/device_description.xml"
+		}
+		return entry
+	}
+	if !strings.Contains(entry, ":") {
+		entry += ":1400"
+	}
+	return "http://" + entry + "/xml/device_description.xml"
+}
+
+// probeStaticSpeakers fetches the description of every configured speaker
+// in parallel. Unreachable entries are logged and left out.
+func probeStaticSpeakers(locations []string) map[string]*SonosSpeaker {
+	result := make(map[string]*SonosSpeaker)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, loc := range locations {
+		wg.Add(1)
+		go func(loc string) {
+			defer wg.Done()
+			s := fetchSpeakerInfo(loc, "")
+			if s == nil {
+				log.Printf("Configured speaker %s did not answer", loc)
+				return
+			}
+			s.Source = sourceConfig
+			mu.Lock()
+			result[s.ID] = s
+			mu.Unlock()
+		}(loc)
+	}
+	wg.Wait()
+	return result
+}
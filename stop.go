@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// --------------- Stop ---------------
+
+// upnpTransitionNotAvailable is what a player answers to Stop when nothing
+// is playing.
+const upnpTransitionNotAvailable = 701
+
+// errSpeakerStopped cuts one speaker's clip short when it is taken out of
+// an announcement that carries on elsewhere.
+var errSpeakerStopped = errors.New("speaker stopped")
+
+// stopResult reports what stopping a speaker did.
+type stopResult struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	// Stopped is "announcement" when the speaker was taken out of an
+	// announcement and restored, or "playback" when the player itself was
+	// stopped.
+	Stopped      string `json:"stopped"`
+	Announcement string `json:"announcement,omitempty"`
+}
+
+// resolveStopTarget looks up the speaker named by name and the coordinator
+// whose transport it follows. Both are copies.
+func resolveStopTarget(name string) (speaker, coordinator *SonosSpeaker, err error) {
+	speakersMu.RLock()
+	defer speakersMu.RUnlock()
+	s, err := resolveSpeakerLocked(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := s
+	if _, group := speakerRoleLocked(s); group != nil {
+		c = group
+	}
+	sc, cc := *s, *c
+	return &sc, &cc, nil
+}
+
+// speakerStops lets one speaker be taken out of a playing announcement.
+// Backends that play each speaker on its own register it for as long as its
+// clip plays and is restored. The zero value is ready to use.
+type speakerStops struct {
+	mu      sync.Mutex
+	playing map[string]*speakerStop
+}
+
+type speakerStop struct {
+	cancel  context.CancelCauseFunc
+	stopped bool
+	done    chan struct{} // closed once the speaker is restored
+}
+
+// begin registers the speaker and returns the context its clip plays under.
+// end must be called once the speaker is restored. A nil st registers
+// nothing.
+func (st *speakerStops) begin(ctx context.Context, id string) (_ context.Context, end func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if st == nil {
+		return ctx, func() { cancel(nil) }
+	}
+	e := &speakerStop{cancel: cancel, done: make(chan struct{})}
+	st.mu.Lock()
+	if st.playing == nil {
+		st.playing = make(map[string]*speakerStop)
+	}
+	st.playing[id] = e
+	st.mu.Unlock()
+	return ctx, func() {
+		st.mu.Lock()
+		if st.playing[id] == e {
+			delete(st.playing, id)
+		}
+		st.mu.Unlock()
+		cancel(nil)
+		close(e.done)
+	}
+}
+
+// stop cuts the clip short on the first of ids that is registered and
+// returns a channel closed once that speaker is restored. It refuses, and
+// the caller cancels the whole announcement instead, when none of ids is
+// registered or when that speaker is the last one still playing.
+func (st *speakerStops) stop(ids ...string) (<-chan struct{}, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, id := range ids {
+		e, ok := st.playing[id]
+		if !ok {
+			continue
+		}
+		if e.stopped {
+			return e.done, true
+		}
+		active := 0
+		for _, o := range st.playing {
+			if !o.stopped {
+				active++
+			}
+		}
+		if active < 2 {
+			return nil, false
+		}
+		e.stopped = true
+		e.cancel(errSpeakerStopped)
+		return e.done, true
+	}
+	return nil, false
+}
+
+// stopSpeaker silences a speaker. An announcement playing on it stops its
+// clip there and restores what the speaker played before, while the other
+// speakers play on. If the announcement cannot spare the speaker alone, as
+// in group mode where every player follows one coordinator, or the speaker
+// is the last one still playing it, the whole announcement is cancelled.
+// Without an announcement the speaker's coordinator is sent Stop.
+// Announcements still queued for the speaker are left alone.
+func stopSpeaker(ctx context.Context, speaker, coordinator *SonosSpeaker) (*stopResult, error) {
+	res := &stopResult{Name: speaker.Name, ID: speaker.ID}
+
+	announcementsMu.Lock()
+	a := busySpeakers[speaker.ID]
+	if a == nil {
+		a = busySpeakers[coordinator.ID]
+	}
+	announcementsMu.Unlock()
+	if a != nil {
+		// A member's transport follows its coordinator.
+		done, ok := a.stops.stop(speaker.ID, coordinator.ID)
+		if ok {
+			log.Printf("Stop on %s takes it out of announcement %s", speaker.Name, a.ID)
+		} else if cancelAnnouncement(a) {
+			log.Printf("Stop on %s cancels announcement %s", speaker.Name, a.ID)
+			done, ok = a.done, true
+		}
+		if ok {
+			res.Stopped = "announcement"
+			res.Announcement = a.ID
+			// Answer once the speaker is restored.
+			select {
+			case <-done:
+			case <-ctx.Done():
+			}
+			return res, nil
+		}
+	}
+
+	// A member's transport follows its coordinator.
+	if err := stop(ctx, coordinator); err != nil && upnpErrorCode(err) != upnpTransitionNotAvailable {
+		return nil, err
+	}
+	log.Printf("Stopped %s", coordinator.Name)
+	res.Stopped = "playback"
+	return res, nil
+}
+
+// cancelAllAnnouncements cancels every queued and playing announcement and
+// returns how many there were. Queued ones go first so that none of them
+// starts on the speakers the playing ones free up.
+func cancelAllAnnouncements() int {
+	announcementsMu.Lock()
+	all := append([]*announcement(nil), announcementQueue...)
+	seen := make(map[*announcement]bool)
+	for _, a := range busySpeakers {
+		if !seen[a] {
+			seen[a] = true
+			all = append(all, a)
+		}
+	}
+	announcementsMu.Unlock()
+
+	n := 0
+	for _, a := range all {
+		if cancelAnnouncement(a) {
+			n++
+		}
+	}
+	return n
+}
+
+// handleCancelAnnouncement withdraws a queued announcement or stops a
+// playing one, and answers with its final state once its speakers are
+// restored.
+func handleCancelAnnouncement(w http.ResponseWriter, r *http.Request, a *announcement) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !cancelAnnouncement(a) {
+		http.Error(w, "announcement already finished", http.StatusConflict)
+		return
+	}
+	log.Printf("Announcement %s cancelled through the API", a.ID)
+	select {
+	case <-a.done:
+	case <-r.Context().Done():
+		return
+	}
+
+	announcementsMu.Lock()
+	resp := announcementJSONLocked(a)
+	announcementsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleStopSpeaker(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	speaker, coordinator, err := resolveStopTarget(id)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errSpeakerNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	res, err := stopSpeaker(r.Context(), speaker, coordinator)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------- Zone Group Topology ---------------
+
+// topologyMaxAge is how long a fetched topology is trusted before it is
+// refreshed. Users regroup rooms in the Sonos app at any time.
+const topologyMaxAge = 30 * time.Second
+
+// topologyRefreshing is held while a background refresh runs, so that
+// announcements arriving together start only one.
+var topologyRefreshing sync.Mutex
+
+// Player roles within a zone group.
+const (
+	roleCoordinator = "coordinator" // receives transport commands for the group
+	roleMember      = "member"      // grouped with another player, follows its coordinator
+	roleBonded      = "bonded"      // invisible half of a stereo pair, sub or surround
+)
+
+type zoneGroup struct {
+	ID          string       `xml:"ID,attr"`
+	Coordinator string       `xml:"Coordinator,attr"`
+	Members     []zoneMember `xml:"ZoneGroupMember"`
+}
+
+type zoneMember struct {
+	UUID       string       `xml:"UUID,attr"`
+	Location   string       `xml:"Location,attr"`
+	ZoneName   string       `xml:"ZoneName,attr"`
+	Invisible  string       `xml:"Invisible,attr"`
+	Satellites []zoneMember `xml:"Satellite"`
+}
+
+// zoneGroupStateXML accepts both the older bare <ZoneGroups> document and the
+// newer <ZoneGroupState><ZoneGroups>… wrapper returned by GetZoneGroupState.
+type zoneGroupStateXML struct {
+	Groups  []zoneGroup `xml:"ZoneGroup"`
+	Wrapped []zoneGroup `xml:"ZoneGroups>ZoneGroup"`
+}
+
+// zonePlayer is one physical player's place in the topology.
+type zonePlayer struct {
+	UUID        string
+	Name        string
+	Location    string // base URL, matches SonosSpeaker.Location
+	Role        string
+	Coordinator *zonePlayer
+}
+
+type zoneTopology struct {
+	players map[string]*zonePlayer // by UUID, matches SonosSpeaker.ID
+	fetched time.Time
+}
+
+var (
+	topology   = &zoneTopology{players: make(map[string]*zonePlayer)}
+	topologyMu sync.RWMutex
+)
+
+// fetchZoneGroupState asks one player for the household's zone groups.
+func fetchZoneGroupState(ctx context.Context, s *SonosSpeaker) ([]zoneGroup, error) {
+	var resp zoneGroupStateInfo
+	if err := s.invoke(ctx, zoneGroupTopologyService, "GetZoneGroupState", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	var state zoneGroupStateXML
+	if err := xml.Unmarshal([]byte(resp.ZoneGroupState), &state); err != nil {
+		return nil, fmt.Errorf("ZoneGroupState: %w", err)
+	}
+	return append(state.Groups, state.Wrapped...), nil
+}
+
+// refreshTopology rebuilds the topology from the currently known speakers.
+// Every speaker reports its whole household, so only speakers not covered by
+// an earlier answer (e.g. a second household) are queried. Speakers known to
+// be offline are skipped rather than waited on. The topology is shared, so
+// no caller's cancellation applies to it.
+func refreshTopology() {
+	ctx := context.Background()
+
+	speakersMu.RLock()
+	list := make([]*SonosSpeaker, 0, len(speakers))
+	for _, s := range speakers {
+		if s.Online {
+			list = append(list, s)
+		}
+	}
+	speakersMu.RUnlock()
+
+	next := &zoneTopology{players: make(map[string]*zonePlayer), fetched: time.Now()}
+	seenGroups := make(map[string]bool)
+	for _, s := range list {
+		if _, covered := next.players[s.ID]; covered {
+			continue
+		}
+		groups, err := fetchZoneGroupState(ctx, s)
+		if err != nil {
+			log.Printf("Zone topology from %s failed: %v", s.Name, err)
+			continue
+		}
+		for _, g := range groups {
+			if seenGroups[g.ID] {
+				continue
+			}
+			seenGroups[g.ID] = true
+			next.addGroup(g)
+		}
+	}
+
+	topologyMu.Lock()
+	topology = next
+	topologyMu.Unlock()
+}
+
+// refreshTopologyIfStale starts a background refresh when the topology is
+// older than topologyMaxAge. The caller goes on with the topology it has, so
+// a slow speaker never holds up an announcement.
+func refreshTopologyIfStale() {
+	topologyMu.RLock()
+	stale := time.Since(topology.fetched) > topologyMaxAge
+	topologyMu.RUnlock()
+
+	if stale && topologyRefreshing.TryLock() {
+		go func() {
+			defer topologyRefreshing.Unlock()
+			refreshTopology()
+		}()
+	}
+}
+
+// runTopologyRefresh keeps the topology fresh between discovery scans, so
+// announcements rarely find it stale.
+func runTopologyRefresh() {
+	ticker := time.NewTicker(topologyMaxAge / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		refreshTopologyIfStale()
+	}
+}
+
+func (t *zoneTopology) addGroup(g zoneGroup) {
+	var coordinator *zonePlayer
+	var added []*zonePlayer
+	add := func(m zoneMember, bonded bool) {
+		p := &zonePlayer{
+			UUID:     m.UUID,
+			Name:     m.ZoneName,
+			Location: baseURLOf(m.Location),
+			Role:     roleMember,
+		}
+		switch {
+		case m.UUID == g.Coordinator:
+			p.Role = roleCoordinator
+			coordinator = p
+		case bonded || m.Invisible == "1":
+			p.Role = roleBonded
+		}
+		t.players[p.UUID] = p
+		added = append(added, p)
+	}
+
+	for _, m := range g.Members {
+		add(m, false)
+		for _, sat := range m.Satellites {
+			add(sat, true)
+		}
+	}
+	for _, p := range added {
+		p.Coordinator = coordinator
+	}
+}
+
+// player returns the topology entry for a speaker, or nil if the speaker was
+// not part of any fetched group.
+func (t *zoneTopology) player(s *SonosSpeaker) *zonePlayer {
+	return t.players[s.ID]
+}
+
+// coordinatorSpeakerLocked maps a speaker to the speaker that should receive
+// transport commands on its behalf: the coordinator of its zone group. If
+// the coordinator has not been discovered itself, a speaker is built from the
+// topology entry. The caller must hold speakersMu and topologyMu for reading.
+func coordinatorSpeakerLocked(s *SonosSpeaker) *SonosSpeaker {
+	p := topology.player(s)
+	if p == nil || p.Coordinator == nil || p.Coordinator.UUID == s.ID {
+		return s
+	}
+	if c, ok := speakers[p.Coordinator.UUID]; ok {
+		return c
+	}
+	return &SonosSpeaker{
+		Name:     p.Coordinator.Name,
+		ID:       p.Coordinator.UUID,
+		Alias:    speakerAlias(p.Coordinator.Name),
+		Location: p.Coordinator.Location,
+	}
+}
+
+// announceTargetsLocked resolves an announcement target to the players that
+// should receive transport commands: one coordinator per zone group, so
+// grouped rooms and bonded surrounds/subs hear the clip exactly once. target
+// is "all" or a comma-separated list of speakers. For "all", groups whose
+// coordinator is offline are skipped. The caller must hold speakersMu for
+// reading.
+func announceTargetsLocked(target string) ([]*SonosSpeaker, error) {
+	if target == "" || target == "all" {
+		topologyMu.RLock()
+		defer topologyMu.RUnlock()
+
+		var targets []*SonosSpeaker
+		seen := make(map[string]bool)
+		for _, s := range speakers {
+			c := coordinatorSpeakerLocked(s)
+			if seen[c.ID] {
+				continue
+			}
+			seen[c.ID] = true
+			if _, known := speakers[c.ID]; known && !c.Online {
+				log.Printf("Skipping offline speaker %s", c.Name)
+				continue
+			}
+			targets = append(targets, c)
+		}
+		return targets, nil
+	}
+
+	// A comma-separated list names several speakers.
+	var targets []*SonosSpeaker
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(target, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		// Resolve before taking topologyMu: alias resolution reads it too.
+		s, err := resolveSpeakerLocked(name)
+		if err != nil {
+			return nil, err
+		}
+
+		topologyMu.RLock()
+		c := coordinatorSpeakerLocked(s)
+		topologyMu.RUnlock()
+
+		if c != s {
+			log.Printf("%s is grouped, announcing through coordinator %s", s.Name, c.Name)
+		}
+		if !seen[c.ID] {
+			seen[c.ID] = true
+			targets = append(targets, c)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%w: %q", errSpeakerNotFound, target)
+	}
+	return targets, nil
+}
+
+// groupMembersLocked returns the visible players that follow coordinator c,
+// excluding c itself and bonded satellites, which always play with their
+// primary. Members the topology knows but discovery has not found are built
+// from their topology entry. The caller must hold speakersMu for reading.
+func groupMembersLocked(c *SonosSpeaker) []*SonosSpeaker {
+	topologyMu.RLock()
+	defer topologyMu.RUnlock()
+
+	var members []*SonosSpeaker
+	for _, p := range topology.players {
+		if p.Role != roleMember || p.Coordinator == nil || p.Coordinator.UUID != c.ID {
+			continue
+		}
+		if s, ok := speakers[p.UUID]; ok {
+			members = append(members, s)
+			continue
+		}
+		members = append(members, &SonosSpeaker{
+			Name:     p.Name,
+			ID:       p.UUID,
+			Alias:    speakerAlias(p.Name),
+			Location: p.Location,
+			Online:   true,
+		})
+	}
+	return members
+}
+
+// speakerRoleLocked reports a speaker's role and its group coordinator. The
+// role is empty and the coordinator nil when the topology does not know the
+// speaker. The caller must hold speakersMu for reading.
+func speakerRoleLocked(s *SonosSpeaker) (string, *SonosSpeaker) {
+	topologyMu.RLock()
+	defer topologyMu.RUnlock()
+
+	p := topology.player(s)
+	if p == nil {
+		return "", nil
+	}
+	return p.Role, coordinatorSpeakerLocked(s)
+}
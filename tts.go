@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --------------- Text-to-Speech ---------------
+
+// TTS engine names, as TTS_ENGINE takes them.
+const (
+	ttsAuto      = "auto"
+	ttsSay       = "say"
+	ttsPiper     = "piper"
+	ttsPico2Wave = "pico2wave"
+	ttsEspeakNG  = "espeak-ng"
+)
+
+// ttsProbeTimeout bounds the test sentence every engine speaks at startup.
+// Piper loads its voice model first, which takes a moment.
+const ttsProbeTimeout = 20 * time.Second
+
+// ttsEngine renders text as uncompressed speech.
+type ttsEngine interface {
+	name() string
+	// probe checks that the engine is installed and configured, without
+	// running it.
+	probe() error
+	// synthesize speaks text into a WAV or AIFF file named base plus the
+	// engine's extension, and returns its path.
+	synthesize(ctx context.Context, text, base string) (string, error)
+}
+
+var errNoTTSEngine = errors.New("no TTS engine available")
+
+var (
+	// tts is the engine chosen through TTS_ENGINE, nil if none works, and
+	// ttsErr says why.
+	tts    ttsEngine
+	ttsErr error
+	// clipEncoder is the command that compresses speech for the speakers,
+	// "" to serve it uncompressed.
+	clipEncoder string
+)
+
+// loadTTSEngine reads TTS_ENGINE and each engine's settings and returns the
+// first engine that speaks a test sentence: the configured one, or with
+// "auto" (default) say, piper, pico2wave and espeak-ng in that order. The
+// error lists why each candidate failed.
+func loadTTSEngine() (ttsEngine, error) {
+	want := strings.ToLower(strings.TrimSpace(os.Getenv("TTS_ENGINE")))
+	if want == "" {
+		want = ttsAuto
+	}
+	// A voice name only means something to one engine, so TTS_VOICE applies
+	// to the engine TTS_ENGINE names and each engine has its own setting.
+	voice := func(engine, name string) string {
+		if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+			return v
+		}
+		if want == engine {
+			return strings.TrimSpace(os.Getenv("TTS_VOICE"))
+		}
+		return ""
+	}
+	engines := []ttsEngine{
+		sayEngine{voice: voice(ttsSay, "SAY_VOICE")},
+		piperEngine{model: strings.TrimSpace(os.Getenv("PIPER_MODEL"))},
+		pico2waveEngine{lang: voice(ttsPico2Wave, "PICO2WAVE_LANG")},
+		espeakEngine{voice: voice(ttsEspeakNG, "ESPEAK_VOICE")},
+	}
+
+	var failures []string
+	for _, e := range engines {
+		if want != ttsAuto && e.name() != want {
+			continue
+		}
+		if err := probeTTSEngine(e); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", e.name(), err))
+			continue
+		}
+		return e, nil
+	}
+	if len(failures) == 0 {
+		return nil, fmt.Errorf("%w: unknown TTS_ENGINE %q, use %s, %s, %s, %s or %s",
+			errNoTTSEngine, want, ttsAuto, ttsSay, ttsPiper, ttsPico2Wave, ttsEspeakNG)
+	}
+	return nil, fmt.Errorf("%w: %s", errNoTTSEngine, strings.Join(failures, "; "))
+}
+
+// probeTTSEngine makes e speak a short test sentence and checks that the
+// result can be read, so a broken install is caught before the first
+// announcement.
+func probeTTSEngine(e ttsEngine) error {
+	if err := e.probe(); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "sonos-gateway-tts")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ttsProbeTimeout)
+	defer cancel()
+	path, err := e.synthesize(ctx, "Test", filepath.Join(dir, "probe"))
+	if err != nil {
+		return err
+	}
+	if _, err := readPCM(path); err != nil {
+		return fmt.Errorf("unreadable output: %w", err)
+	}
+	return nil
+}
+
+// findClipEncoder picks the command that compresses speech: afconvert on
+// macOS, otherwise ffmpeg or lame. Without one the speech is served as it
+// comes from the engine; Sonos players play WAV and AIFF too.
+func findClipEncoder() string {
+	for _, cmd := range []string{"afconvert", "ffmpeg", "lame"} {
+		if _, err := exec.LookPath(cmd); err == nil {
+			return cmd
+		}
+	}
+	return ""
+}
+
+// generateTTS renders text, with chime ahead of it, into a clip under tts/
+// and returns its path.
+func generateTTS(ctx context.Context, text, chime string) (string, error) {
+	if tts == nil {
+		return "", ttsErr
+	}
+	base := filepath.Join("tts", fmt.Sprintf("%d", time.Now().UnixNano()))
+	speechPath, err := tts.synthesize(ctx, text, base)
+	if err != nil {
+		return "", err
+	}
+
+	// A chime that cannot be joined on is not worth losing the message.
+	if chime != "" {
+		if err := prependChime(speechPath, chime); err != nil {
+			log.Printf("Chime %q not played: %v", chime, err)
+		}
+	}
+	return encodeSpeech(ctx, speechPath, base)
+}
+
+// encodeSpeech compresses the speech at path with clipEncoder into base
+// plus the encoded extension, and returns the path of the result.
+func encodeSpeech(ctx context.Context, path, base string) (string, error) {
+	out := base + ".mp3"
+	switch clipEncoder {
+	case "afconvert":
+		if err := runCommand(ctx, "", "afconvert", "-f", "mp3 ", "-d", ".mp3", path, out); err != nil {
+			// Fallback: try AAC if MP3 encoding is unavailable
+			out = base + ".m4a"
+			if err2 := runCommand(ctx, "", "afconvert", "-f", "mp4f", "-d", "aac", path, out); err2 != nil {
+				return "", fmt.Errorf("afconvert failed (mp3: %v, aac: %v)", err, err2)
+			}
+		}
+	case "ffmpeg":
+		if err := runCommand(ctx, "", "ffmpeg", "-nostdin", "-loglevel", "error", "-y",
+			"-i", path, "-codec:a", "libmp3lame", "-q:a", "4", out); err != nil {
+			return "", err
+		}
+	case "lame":
+		if err := runCommand(ctx, "", "lame", "--quiet", path, out); err != nil {
+			return "", err
+		}
+	default:
+		return path, nil
+	}
+	os.Remove(path)
+	return out, nil
+}
+
+// runCommand runs name with args, feeding it stdin if that is not empty.
+// The error carries whatever the command printed to stderr.
+func runCommand(ctx context.Context, stdin, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s failed: %w: %s", name, err, msg)
+		}
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
+
+// lookCommand checks that name is on the PATH.
+func lookCommand(name string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%s not found on PATH", name)
+	}
+	return nil
+}
+
+// sayEngine is the macOS speech synthesizer. SAY_VOICE picks one of its
+// voices, e.g. Samantha.
+type sayEngine struct{ voice string }
+
+func (sayEngine) name() string { return ttsSay }
+
+func (sayEngine) probe() error { return lookCommand("say") }
+
+func (e sayEngine) synthesize(ctx context.Context, text, base string) (string, error) {
+	out := base + ".aiff"
+	args := []string{"-o", out}
+	if e.voice != "" {
+		args = append(args, "-v", e.voice)
+	}
+	return out, runCommand(ctx, "", "say", append(args, text)...)
+}
+
+// piperEngine runs Piper, a neural synthesizer, with the voice model at
+// PIPER_MODEL. The model's .onnx.json config must sit next to it.
+type piperEngine struct{ model string }
+
+func (piperEngine) name() string { return ttsPiper }
+
+func (e piperEngine) probe() error {
+	if err := lookCommand("piper"); err != nil {
+		return err
+	}
+	if e.model == "" {
+		return errors.New("PIPER_MODEL is not set")
+	}
+	if _, err := os.Stat(e.model); err != nil {
+		return fmt.Errorf("voice model: %w", err)
+	}
+	return nil
+}
+
+func (e piperEngine) synthesize(ctx context.Context, text, base string) (string, error) {
+	out := base + ".wav"
+	// Piper reads the text from stdin, one utterance per line.
+	text = strings.Join(strings.Fields(text), " ")
+	return out, runCommand(ctx, text, "piper", "--model", e.model, "--output_file", out)
+}
+
+// pico2waveEngine runs SVOX Pico. PICO2WAVE_LANG picks its language, e.g.
+// en-GB; it defaults to en-US.
+type pico2waveEngine struct{ lang string }
+
+func (pico2waveEngine) name() string { return ttsPico2Wave }
+
+func (pico2waveEngine) probe() error { return lookCommand("pico2wave") }
+
+func (e pico2waveEngine) synthesize(ctx context.Context, text, base string) (string, error) {
+	lang := e.lang
+	if lang == "" {
+		lang = "en-US"
+	}
+	// pico2wave insists on the .wav extension.
+	out := base + ".wav"
+	return out, runCommand(ctx, "", "pico2wave", "-l", lang, "-w", out, "--", text)
+}
+
+// espeakEngine runs eSpeak NG. ESPEAK_VOICE picks its voice, e.g. en-us or
+// en+f3.
+type espeakEngine struct{ voice string }
+
+func (espeakEngine) name() string { return ttsEspeakNG }
+
+func (espeakEngine) probe() error { return lookCommand("espeak-ng") }
+
+func (e espeakEngine) synthesize(ctx context.Context, text, base string) (string, error) {
+	out := base + ".wav"
+	args := []string{"-w", out, "--stdin"}
+	if e.voice != "" {
+		args = append(args, "-v", e.voice)
+	}
+	return out, runCommand(ctx, text, "espeak-ng", args...)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --------------- Announcement Volume ---------------
+
+// noVolume leaves a speaker's volume as it is.
+const noVolume = -1
+
+var (
+	// defaultAnnounceVolume is the ANNOUNCE_VOLUME setting, used for speakers
+	// without their own entry.
+	defaultAnnounceVolume = noVolume
+	// announceVolumes holds the ANNOUNCE_VOLUMES entries, keyed by lower-case
+	// speaker ID, alias or room name.
+	announceVolumes map[string]int
+)
+
+// loadAnnounceVolumes reads ANNOUNCE_VOLUME (0-100) and ANNOUNCE_VOLUMES, a
+// comma-separated list of speaker=volume pairs such as
+// "kitchen=30,Living Room=25".
+func loadAnnounceVolumes() (int, map[string]int) {
+	def := noVolume
+	if v := os.Getenv("ANNOUNCE_VOLUME"); v != "" {
+		if vol, ok := parseVolume(v); ok {
+			def = vol
+		} else {
+			log.Printf("Invalid ANNOUNCE_VOLUME %q, announcements keep the speaker volume", v)
+		}
+	}
+
+	perSpeaker := make(map[string]int)
+	for _, entry := range strings.Split(os.Getenv("ANNOUNCE_VOLUMES"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, v, found := strings.Cut(entry, "=")
+		vol, ok := parseVolume(v)
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !found || !ok || name == "" {
+			log.Printf("Invalid ANNOUNCE_VOLUMES entry %q, expected speaker=0-100", entry)
+			continue
+		}
+		perSpeaker[name] = vol
+	}
+	return def, perSpeaker
+}
+
+func parseVolume(v string) (int, bool) {
+	vol, err := strconv.Atoi(strings.TrimSpace(v))
+	return vol, err == nil && validVolume(vol)
+}
+
+func validVolume(vol int) bool {
+	return vol >= 0 && vol <= 100
+}
+
+// announceVolumeFor returns the configured announcement volume of a speaker,
+// or noVolume when neither its own entry nor ANNOUNCE_VOLUME is set.
+func announceVolumeFor(s *SonosSpeaker) int {
+	for _, key := range []string{s.ID, s.Alias, s.Name} {
+		if vol, ok := announceVolumes[strings.ToLower(key)]; ok {
+			return vol
+		}
+	}
+	return defaultAnnounceVolume
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsPipe connects a client wsConn to the raw server end of an in-memory
+// connection. net.Pipe is unbuffered, so the two ends must be driven from
+// different goroutines.
+func wsPipe(t *testing.T) (*wsConn, *wsServer) {
+	t.Helper()
+	client, server := net.Pipe()
+	deadline := time.Now().Add(5 * time.Second)
+	client.SetDeadline(deadline)
+	server.SetDeadline(deadline)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return &wsConn{conn: client, br: bufio.NewReader(client)}, &wsServer{conn: server, br: bufio.NewReader(server)}
+}
+
+// wsServer is the server end of a test connection. It writes unmasked
+// frames and expects masked ones, as servers do.
+type wsServer struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func (s *wsServer) writeFrame(fin bool, op byte, payload []byte) error {
+	b := op
+	if fin {
+		b |= 0x80
+	}
+	frame := []byte{b}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	_, err := s.conn.Write(append(frame, payload...))
+	return err
+}
+
+// readFrame reads one client frame and also returns its 7-bit length field,
+// to check which length encoding the client chose.
+func (s *wsServer) readFrame() (op byte, lengthField byte, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(s.br, h[:]); err != nil {
+		return
+	}
+	if h[0]&0x80 == 0 || h[1]&0x80 == 0 {
+		err = errors.New("client frame not final or not masked")
+		return
+	}
+	op, lengthField = h[0]&0x0F, h[1]&0x7F
+	n := uint64(lengthField)
+	switch lengthField {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(s.br, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(s.br, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(s.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(s.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func TestWebSocketLengths(t *testing.T) {
+	tests := []struct {
+		size        int
+		lengthField byte
+	}{
+		{0, 0},
+		{125, 125},
+		{126, 126},
+		{0xFFFF, 126},
+		{0x10000, 127},
+		{wsMaxMessage, 127},
+	}
+	for _, tt := range tests {
+		payload := bytes.Repeat([]byte("x"), tt.size)
+		ws, srv := wsPipe(t)
+
+		errc := make(chan error, 1)
+		go func() { errc <- srv.writeFrame(true, wsOpText, payload) }()
+		got, err := ws.readMessage()
+		if err != nil {
+			t.Fatalf("%d bytes: readMessage: %v", tt.size, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("%d bytes: server write: %v", tt.size, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("%d bytes: read %d bytes back", tt.size, len(got))
+		}
+
+		go func() { errc <- ws.writeText(payload) }()
+		op, lengthField, got, err := srv.readFrame()
+		if err != nil {
+			t.Fatalf("%d bytes: server read: %v", tt.size, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("%d bytes: writeText: %v", tt.size, err)
+		}
+		if op != wsOpText || lengthField != tt.lengthField || !bytes.Equal(got, payload) {
+			t.Errorf("%d bytes: client sent opcode %d, length field %d, %d bytes; want %d, %d, %d",
+				tt.size, op, lengthField, len(got), wsOpText, tt.lengthField, tt.size)
+		}
+	}
+}
+
+func TestWebSocketOversizedFrame(t *testing.T) {
+	ws, srv := wsPipe(t)
+	go func() {
+		header := binary.BigEndian.AppendUint64([]byte{0x80 | wsOpText, 127}, wsMaxMessage+1)
+		srv.conn.Write(header)
+	}()
+	if _, err := ws.readMessage(); err == nil {
+		t.Fatal("readMessage accepted a frame over wsMaxMessage")
+	}
+}
+
+func TestWebSocketFragmentsAndPing(t *testing.T) {
+	ws, srv := wsPipe(t)
+
+	type frame struct {
+		fin     bool
+		op      byte
+		payload string
+	}
+	// Control frames may arrive between the fragments of a message.
+	frames := []frame{
+		{false, wsOpText, "Hel"},
+		{true, wsOpPing, "are you there"},
+		{false, 0, "lo, "},
+		{true, wsOpPong, "unsolicited"},
+		{true, 0, "world"},
+	}
+	errc := make(chan error, 1)
+	go func() {
+		for _, f := range frames {
+			if err := srv.writeFrame(f.fin, f.op, []byte(f.payload)); err != nil {
+				errc <- err
+				return
+			}
+			if f.op == wsOpPing {
+				op, _, payload, err := srv.readFrame()
+				if err == nil && (op != wsOpPong || string(payload) != f.payload) {
+					err = fmt.Errorf("ping answered with opcode %d and payload %q", op, payload)
+				}
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+		}
+		errc <- nil
+	}()
+
+	got, err := ws.readMessage()
+	if err != nil {
+		t.Fatalf("readMessage: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	if string(got) != "Hello, world" {
+		t.Errorf("readMessage = %q, want %q", got, "Hello, world")
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	t.Run("server closes", func(t *testing.T) {
+		ws, srv := wsPipe(t)
+		reply := make(chan []byte, 1)
+		go func() {
+			payload := append(binary.BigEndian.AppendUint16(nil, 1001), "going away"...)
+			srv.writeFrame(true, wsOpClose, payload)
+			op, _, payload, err := srv.readFrame()
+			if err != nil || op != wsOpClose {
+				payload = nil
+			}
+			reply <- payload
+		}()
+
+		if _, err := ws.readMessage(); !errors.Is(err, errWebSocketClosed) {
+			t.Fatalf("readMessage error = %v, want errWebSocketClosed", err)
+		}
+		// The client echoes the status code without the reason.
+		if got := <-reply; !bytes.Equal(got, []byte{0x03, 0xE9}) {
+			t.Errorf("client answered close with %v, want status 1001", got)
+		}
+	})
+
+	t.Run("client closes", func(t *testing.T) {
+		ws, srv := wsPipe(t)
+		done := make(chan error, 1)
+		go func() { done <- ws.close() }()
+
+		op, _, payload, err := srv.readFrame()
+		if err != nil {
+			t.Fatalf("server read: %v", err)
+		}
+		if op != wsOpClose || !bytes.Equal(payload, []byte{0x03, 0xE8}) {
+			t.Errorf("client sent opcode %d with %v, want close with status 1000", op, payload)
+		}
+		<-done
+		if _, err := srv.br.ReadByte(); err != io.EOF {
+			t.Errorf("connection still open after close: %v", err)
+		}
+	})
+}
+
+func TestDialWebSocket(t *testing.T) {
+	tests := []struct {
+		name    string
+		accept  func(key string) string
+		status  int
+		wantErr string
+	}{
+		{"accepted", wsAcceptKey, http.StatusSwitchingProtocols, ""},
+		{"bad accept key", func(string) string { return "bogus" }, http.StatusSwitchingProtocols, "Sec-WebSocket-Accept"},
+		{"refused", nil, http.StatusForbidden, "403"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Test") != "yes" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+					http.Error(w, "bad handshake", http.StatusBadRequest)
+					return
+				}
+				if tt.accept == nil {
+					http.Error(w, "no", tt.status)
+					return
+				}
+				conn, rw, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+				rw.WriteString("Sec-WebSocket-Accept: " + tt.accept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+				rw.Flush()
+
+				// Echo one message back.
+				s := &wsServer{conn: conn, br: rw.Reader}
+				if _, _, payload, err := s.readFrame(); err == nil {
+					s.writeFrame(true, wsOpText, payload)
+				}
+			}))
+			defer srv.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/websocket/api"
+			ws, err := dialWebSocket(ctx, url, http.Header{"X-Test": {"yes"}}, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("dialWebSocket error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialWebSocket: %v", err)
+			}
+			defer ws.close()
+			ws.conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := ws.writeText([]byte("echo")); err != nil {
+				t.Fatalf("writeText: %v", err)
+			}
+			if got, err := ws.readMessage(); err != nil || string(got) != "echo" {
+				t.Errorf("readMessage = %q, %v, want %q", got, err, "echo")
+			}
+		})
+	}
+}